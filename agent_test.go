@@ -16,8 +16,11 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/system"
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
@@ -75,6 +78,23 @@ func (s *AgentTestSuite) SetupTest() {
 	s.setupMockAuthServer()
 	s.setupMockAPIServer()
 	os.Setenv("RESIM_AGENT_ONE_TASK", "true")
+	s.mockDocker.On("ServerVersion", mock.Anything).Return(types.Version{Version: "27.5.0", APIVersion: "1.47"}, nil).Maybe()
+	s.expectWorkerImageGC()
+	s.expectNoOrphanedWorkers()
+}
+
+// expectNoOrphanedWorkers expects the agent to look for workers from a previous run
+// on startup; there are none.
+func (s *AgentTestSuite) expectNoOrphanedWorkers() {
+	s.mockDocker.On("ContainerList", mock.Anything, mock.Anything).Return([]types.Container{}, nil).Maybe()
+}
+
+// expectWorkerImageGC allows the runtime's disk usage to be checked on startup,
+// and old worker images to be looked for after a successful run; there are none
+// to remove.
+func (s *AgentTestSuite) expectWorkerImageGC() {
+	s.mockDocker.On("Info", mock.Anything).Return(system.Info{DockerRootDir: os.TempDir()}, nil).Maybe()
+	s.mockDocker.On("ImageList", mock.Anything, mock.Anything).Return([]image.Summary{}, nil).Maybe()
 }
 
 func (s *AgentTestSuite) TearDownTest() {
@@ -508,6 +528,39 @@ func (s *AgentTestSuite) TestGetOrgNameTokenError() {
 	s.Empty(s.agent.OrgName)
 }
 
+func (s *AgentTestSuite) TestLogin() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	orgName, err := s.agent.Login()
+	s.NoError(err)
+	s.Equal(DefaultTestOrgName, orgName)
+	s.FileExists(filepath.Join(s.agent.ConfigDirOverride, CredentialCacheFilename))
+}
+
+func (s *AgentTestSuite) TestLoginAuthError() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	// A failed token request is returned rather than exiting
+	s.mockAuthServer.Close()
+	_, err = s.agent.Login()
+	s.ErrorContains(err, "error in auth")
+
+	s.mockAuthServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"error": "invalid_grant"}`)
+	}))
+	s.agent.AuthHost = s.mockAuthServer.URL
+	_, err = s.agent.Login()
+	s.ErrorContains(err, "check the username and password")
+}
+
 func (s *AgentTestSuite) TestGetOrgNameNoOrgName() {
 	s.agent.ConfigDirOverride = s.createConfigFile()
 
@@ -564,6 +617,8 @@ func (s *AgentTestSuite) setupMockAPIServer() *httptest.Server {
 			io.WriteString(w, "")
 		case path == "/heartbeat":
 			io.WriteString(w, "")
+		case path == "/health" || path == "/agentapiping":
+			io.WriteString(w, "")
 		case strings.HasSuffix(path, "/checkin"):
 			io.WriteString(w, `{"workerImageURI": "public.ecr.aws/resim/experience-worker:ef41d3b7a46a502fef074eb1fd0a1aff54f7a538", "authToken": "foo-worker-token", "workerEnvironmentVariables": [["RERUN_WORKER_STUFF", "yes"]]}`)
 		default:
@@ -585,3 +640,220 @@ func createTestContainer(status string, running bool) types.ContainerJSON {
 		},
 	}
 }
+
+// expectSuccessfulWorkerRun sets up the Docker mock for a worker that is pulled,
+// runs once and exits successfully, returning the worker's container ID.
+func (s *AgentTestSuite) expectSuccessfulWorkerRun() string {
+	ioR := io.NopCloser(strings.NewReader("thing"))
+	s.mockDocker.On("ImagePull", mock.Anything, mock.Anything, mock.Anything).Return(ioR, nil).Once()
+
+	containerID := uuid.UUID.String(uuid.New())
+	s.mockDocker.On("ContainerCreate", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(container.CreateResponse{
+		ID: containerID,
+	}, nil).Once()
+	s.mockDocker.On("ContainerStart", mock.Anything, containerID, container.StartOptions{}).Return(nil).Once()
+	s.mockDocker.On("ContainerInspect", mock.Anything, containerID).Return(createTestContainer("running", true), nil).Once()
+	s.mockDocker.On("ContainerInspect", mock.Anything, containerID).Return(createTestContainer("exited", false), nil).Once()
+	s.mockDocker.On("ContainerRemove", mock.Anything, containerID, mock.Anything).Return(nil).Once()
+	return containerID
+}
+
+func (s *AgentTestSuite) TestStartTraces() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	recorder := setupTestTracing(s.T())
+	s.expectSuccessfulWorkerRun()
+
+	err = s.agent.Start()
+	s.NoError(err)
+
+	spanNames := map[string]bool{}
+	var traceIDs []string
+	for _, span := range recorder.Ended() {
+		if span.Name() == "agent.heartbeat" {
+			continue
+		}
+		spanNames[span.Name()] = true
+		traceIDs = append(traceIDs, span.SpanContext().TraceID().String())
+	}
+	for _, name := range []string{"agent.iteration", "agent.checkin", "agent.image_pull", "agent.worker", "worker.create", "worker.start", "worker.watch", "worker.remove"} {
+		s.True(spanNames[name], "missing span %v", name)
+	}
+	// All the spans are part of the one iteration's trace
+	s.NotEmpty(traceIDs)
+	for _, traceID := range traceIDs {
+		s.Equal(traceIDs[0], traceID)
+	}
+}
+
+func (s *AgentTestSuite) TestStart_APIUnavailable() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	defaultMinSleep := apiUnavailableMinSleep
+	apiUnavailableMinSleep = time.Millisecond
+	s.T().Cleanup(func() { apiUnavailableMinSleep = defaultMinSleep })
+
+	// The API is down for maintenance for longer than MaxErrorCount checkins, then recovers
+	unavailableRequests := 2 * (s.agent.MaxErrorCount + 1)
+	s.mockAPIServer.Close()
+	s.mockAPIServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unavailableRequests > 0 {
+			unavailableRequests--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"workerImageURI": "public.ecr.aws/resim/experience-worker:ef41d3b7a46a502fef074eb1fd0a1aff54f7a538", "authToken": "foo-worker-token", "workerEnvironmentVariables": [["RERUN_WORKER_STUFF", "yes"]]}`)
+	}))
+	s.agent.APIHost = s.mockAPIServer.URL
+	s.expectSuccessfulWorkerRun()
+
+	err = s.agent.Start()
+	s.NoError(err)
+	s.Equal(APIStatusOK, s.agent.CurrentStatus().APIStatus)
+}
+
+func (s *AgentTestSuite) TestStart_APIUnauthorized() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	s.mockAPIServer.Close()
+	s.mockAPIServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	s.agent.APIHost = s.mockAPIServer.URL
+
+	// Authentication failures count against MaxErrorCount
+	err = s.agent.Start()
+	s.ErrorContains(err, "error checking in")
+	s.Equal(APIStatusUnauthorized, s.agent.CurrentStatus().APIStatus)
+}
+
+// expectWorkerHostConfig captures the host config the worker is created with.
+func (s *AgentTestSuite) expectWorkerHostConfig() (*container.HostConfig, *container.Config) {
+	containerID := s.expectSuccessfulWorkerRun()
+	hostConfig := &container.HostConfig{}
+	config := &container.Config{}
+	for _, call := range s.mockDocker.ExpectedCalls {
+		if call.Method == "ContainerCreate" {
+			call.Run(func(args mock.Arguments) {
+				*config = *args.Get(1).(*container.Config)
+				*hostConfig = *args.Get(2).(*container.HostConfig)
+			})
+		}
+	}
+	s.NotEmpty(containerID)
+	return hostConfig, config
+}
+
+func (s *AgentTestSuite) TestStart_Podman() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+	s.agent.RuntimeHost = "unix:///run/user/1000/podman/podman.sock"
+
+	s.mockDocker.ExpectedCalls = nil
+	s.expectWorkerImageGC()
+	s.expectNoOrphanedWorkers()
+	s.mockDocker.On("ServerVersion", mock.Anything).Return(types.Version{
+		Version:    "5.2.2",
+		APIVersion: "1.41",
+		Components: []types.ComponentVersion{{Name: "Podman Engine", Version: "5.2.2"}},
+	}, nil).Once()
+	hostConfig, _ := s.expectWorkerHostConfig()
+
+	err = s.agent.Start()
+	s.NoError(err)
+
+	s.Equal(ContainerRuntimePodman, s.agent.ContainerRuntime)
+	s.Equal([]string{"label=disable"}, hostConfig.SecurityOpt)
+	s.Equal("/run/user/1000/podman/podman.sock", hostConfig.Mounts[0].Source)
+	s.Equal(DockerSocketPath, hostConfig.Mounts[0].Target)
+}
+
+func (s *AgentTestSuite) TestStart_RemoteRuntime() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+	s.agent.RuntimeHost = "tcp://docker:2375"
+
+	hostConfig, config := s.expectWorkerHostConfig()
+
+	err = s.agent.Start()
+	s.NoError(err)
+
+	s.Equal(ContainerRuntimeDocker, s.agent.ContainerRuntime)
+	s.Empty(hostConfig.SecurityOpt)
+	for _, m := range hostConfig.Mounts {
+		s.NotEqual(DockerSocketPath, m.Target)
+	}
+	s.Contains(config.Env, "DOCKER_HOST=tcp://docker:2375")
+}
+
+func (s *AgentTestSuite) TestStart_ConfiguredPlatform() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+	os.Setenv("RESIM_AGENT_PLATFORM", "linux/arm64")
+	defer os.Unsetenv("RESIM_AGENT_PLATFORM")
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	var reportedPlatform string
+	apiHandler := s.mockAPIServer.Config.Handler
+	s.mockAPIServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/checkin") {
+			reportedPlatform = r.Header.Get("X-ReSim-AgentPlatform")
+		}
+		apiHandler.ServeHTTP(w, r)
+	})
+
+	containerID := s.expectSuccessfulWorkerRun()
+	for _, call := range s.mockDocker.ExpectedCalls {
+		switch call.Method {
+		case "ImagePull":
+			call.Arguments[2] = image.PullOptions{Platform: "linux/arm64"}
+		case "ContainerCreate":
+			call.Arguments[3] = &v1.Platform{OS: "linux", Architecture: "arm64"}
+		}
+	}
+
+	err = s.agent.Start()
+	s.NoError(err)
+	s.NotEmpty(containerID)
+	s.Equal("linux/arm64", reportedPlatform)
+}
+
+func (s *AgentTestSuite) TestStart_ImageLacksPlatform() {
+	s.agent.ConfigDirOverride = s.createConfigFile()
+	os.Setenv("RESIM_AGENT_PLATFORM", "linux/arm64/v8")
+	defer os.Unsetenv("RESIM_AGENT_PLATFORM")
+
+	err := s.agent.LoadConfig()
+	s.NoError(err)
+
+	stream := `{"status":"Pulling from resim/experience-worker","id":"latest"}
+{"errorDetail":{"message":"no matching manifest for linux/arm64/v8 in the manifest list entries"},"error":"no matching manifest for linux/arm64/v8 in the manifest list entries"}
+`
+	// The pull fails each time it is retried
+	for range s.agent.MaxErrorCount + 1 {
+		s.mockDocker.On("ImagePull", mock.Anything, mock.Anything, image.PullOptions{Platform: "linux/arm64/v8"}).Return(io.NopCloser(strings.NewReader(stream)), nil).Once()
+	}
+
+	err = s.agent.Start()
+	var platformErr *ImagePlatformError
+	s.ErrorAs(err, &platformErr)
+	s.ErrorContains(err, "is not available for platform linux/arm64/v8")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// APIStatus is the state of the Agent API as seen by the agent, found by probing
+// its health and ping endpoints.
+type APIStatus string
+
+const (
+	APIStatusUnknown APIStatus = ""
+	APIStatusOK      APIStatus = "ok"
+	// The API could not be reached at all, e.g. because of a network or DNS problem
+	APIStatusUnreachable APIStatus = "unreachable"
+	// The API responded, but is down, e.g. for maintenance
+	APIStatusUnavailable APIStatus = "unavailable"
+	// The API rejected the agent's credentials
+	APIStatusUnauthorized APIStatus = "unauthorized"
+	// The API rejected the agent's request, e.g. because the agent is too old
+	APIStatusBadRequest APIStatus = "bad-request"
+)
+
+const (
+	apiProbeTimeout = 10 * time.Second
+	// apiUnavailableMaxSleep caps the backoff while waiting for the API to come back
+	apiUnavailableMaxSleep = time.Minute
+)
+
+// apiUnavailableMinSleep is the shortest backoff while waiting for the API to
+// come back, so a zero agent-error-sleep doesn't hammer it
+var apiUnavailableMinSleep = time.Second
+
+// probeAPI checks the API's health endpoint, which does not need
+// authentication, and then pings it as the agent, to find out why requests to
+// it are failing. The result is recorded for status reporting.
+func (a *Agent) probeAPI(ctx context.Context) (APIStatus, string) {
+	ctx, cancel := context.WithTimeout(ctx, apiProbeTimeout)
+	defer cancel()
+
+	status, detail := a.checkAPIHealth(ctx)
+	if status == APIStatusOK {
+		status, detail = a.pingAPI(ctx)
+	}
+	apiProbesTotal.WithLabelValues(string(status)).Inc()
+	a.recordAPIStatus(status)
+	return status, detail
+}
+
+func (a *Agent) checkAPIHealth(ctx context.Context) (APIStatus, string) {
+	res, err := a.APIClient.HealthWithResponse(ctx)
+	if err != nil {
+		return APIStatusUnreachable, err.Error()
+	}
+	if res.StatusCode() != http.StatusOK {
+		return APIStatusUnavailable, fmt.Sprintf("health check returned %v", res.Status())
+	}
+	return APIStatusOK, fmt.Sprintf("%v is healthy", a.APIHost)
+}
+
+func (a *Agent) pingAPI(ctx context.Context) (APIStatus, string) {
+	res, err := a.APIClient.AgentAPIPingWithResponse(ctx)
+	if err != nil {
+		return APIStatusUnreachable, err.Error()
+	}
+	return apiStatusFromCode(res.StatusCode()), fmt.Sprintf("ping returned %v", res.Status())
+}
+
+func apiStatusFromCode(code int) APIStatus {
+	switch {
+	case code >= 200 && code < 300:
+		return APIStatusOK
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return APIStatusUnauthorized
+	case code >= 500 || code == http.StatusTooManyRequests:
+		return APIStatusUnavailable
+	default:
+		return APIStatusBadRequest
+	}
+}
+
+// apiUnavailableSleep backs off exponentially from the agent's error sleep while
+// the API is unavailable.
+func (a *Agent) apiUnavailableSleep(attempt int) time.Duration {
+	sleep := max(a.AgentErrorSleep, apiUnavailableMinSleep)
+	for range attempt {
+		sleep *= 2
+		if sleep >= apiUnavailableMaxSleep {
+			return apiUnavailableMaxSleep
+		}
+	}
+	return sleep
+}
+
+// logAPIStatus explains a failed probe of the API.
+func (a *Agent) logAPIStatus(status APIStatus, detail string) {
+	switch status {
+	case APIStatusOK:
+		slog.Info("Agent API is reachable", "api_host", a.APIHost)
+	case APIStatusUnavailable:
+		slog.Warn("Agent API is unavailable, waiting for it to recover", "api_host", a.APIHost, "detail", detail)
+	case APIStatusUnauthorized:
+		slog.Error("Agent API rejected the agent's credentials, check the username, password and auth host", "api_host", a.APIHost, "detail", detail)
+	case APIStatusBadRequest:
+		slog.Error("Agent API rejected the agent's request, the agent may need updating", "api_host", a.APIHost, "detail", detail)
+	default:
+		slog.Error("Agent API is unreachable, check the API host and network", "api_host", a.APIHost, "detail", detail)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIStatusFromCode(t *testing.T) {
+	assert.Equal(t, APIStatusOK, apiStatusFromCode(http.StatusOK))
+	assert.Equal(t, APIStatusUnauthorized, apiStatusFromCode(http.StatusUnauthorized))
+	assert.Equal(t, APIStatusUnauthorized, apiStatusFromCode(http.StatusForbidden))
+	assert.Equal(t, APIStatusUnavailable, apiStatusFromCode(http.StatusServiceUnavailable))
+	assert.Equal(t, APIStatusUnavailable, apiStatusFromCode(http.StatusTooManyRequests))
+	assert.Equal(t, APIStatusBadRequest, apiStatusFromCode(http.StatusBadRequest))
+	assert.Equal(t, APIStatusBadRequest, apiStatusFromCode(http.StatusNotFound))
+}
+
+func TestAPIUnavailableSleep(t *testing.T) {
+	a := New(nil)
+	a.AgentErrorSleep = 5 * time.Second
+	assert.Equal(t, 5*time.Second, a.apiUnavailableSleep(0))
+	assert.Equal(t, 20*time.Second, a.apiUnavailableSleep(2))
+	assert.Equal(t, apiUnavailableMaxSleep, a.apiUnavailableSleep(10))
+}
+
+func TestAPIUnavailableSleep_ZeroErrorSleep(t *testing.T) {
+	a := New(nil)
+	a.AgentErrorSleep = 0
+	assert.Equal(t, apiUnavailableMinSleep, a.apiUnavailableSleep(0))
+	assert.Equal(t, 2*apiUnavailableMinSleep, a.apiUnavailableSleep(1))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -53,13 +54,46 @@ func (a *Agent) Token() (*oauth2.Token, error) {
 		a.CurrentToken = a.authenticate(authModePassword)
 		a.saveCredentialCache()
 	}
+	a.recordAuth(a.CurrentToken.Valid())
 	a.TokenMutex.Unlock()
 
 	return a.CurrentToken, nil
 }
 
+// Login authenticates with the configured username and password, caching the
+// resulting token, and returns the name of the org the agent belongs to.
+func (a *Agent) Login() (string, error) {
+	token, err := a.requestToken(authModePassword)
+	if err != nil {
+		return "", err
+	}
+	if !token.Valid() {
+		return "", errors.New("error logging in: check the username and password")
+	}
+	a.TokenMutex.Lock()
+	a.CurrentToken = token
+	a.saveCredentialCache()
+	a.TokenMutex.Unlock()
+
+	err = a.getOrgName()
+	if err != nil {
+		return "", err
+	}
+	return a.OrgName, nil
+}
+
 func (a *Agent) authenticate(mode AuthMode) *oauth2.Token {
+	tokenRefreshesTotal.WithLabelValues(string(mode)).Inc()
+
+	token, err := a.requestToken(mode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return token
+}
 
+// requestToken requests a token from the auth server using the given grant.
+func (a *Agent) requestToken(mode AuthMode) (*oauth2.Token, error) {
 	tokenURL := fmt.Sprintf("%v/oauth/token", a.AuthHost)
 	username := viper.GetString(UsernameKey)
 	password := viper.GetString(PasswordKey)
@@ -89,9 +123,9 @@ func (a *Agent) authenticate(mode AuthMode) *oauth2.Token {
 
 	req.Header.Add("content-type", "application/x-www-form-urlencoded")
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := a.HTTPClient.Do(req)
 	if err != nil {
-		log.Fatal("error in auth: ", err)
+		return nil, fmt.Errorf("error in auth: %w", err)
 	}
 
 	defer res.Body.Close()
@@ -100,7 +134,7 @@ func (a *Agent) authenticate(mode AuthMode) *oauth2.Token {
 	var tj tokenJSON
 	err = json.Unmarshal(body, &tj)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return &oauth2.Token{
@@ -108,7 +142,7 @@ func (a *Agent) authenticate(mode AuthMode) *oauth2.Token {
 		TokenType:    tj.TokenType,
 		RefreshToken: tj.RefreshToken,
 		Expiry:       time.Now().Add(time.Duration(tj.ExpiresIn) * time.Second),
-	}
+	}, nil
 }
 
 func (a *Agent) loadCredentialCache() {
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configFlags are flags that override config keys of the same name.
+var configFlags = []struct {
+	key   string
+	usage string
+	slice bool
+}{
+	{key: AgentNameKey, usage: "name of the agent shown in ReSim"},
+	{key: PoolLabelsKey, usage: "labels of the pools to run jobs for", slice: true},
+	{key: APIHostKey, usage: "URL of the ReSim Agent API"},
+	{key: AuthHostKey, usage: "URL of the ReSim auth server"},
+	{key: LogLevelKey, usage: "log level: debug, info, warn or error"},
+	{key: LogFormatKey, usage: "log format: text or json"},
+	{key: LogDestinationsKey, usage: "log destinations: stdout, stderr, file or syslog", slice: true},
+	{key: HTTPListenAddressKey, usage: "address for the local HTTP server"},
+}
+
+// cliOptions are the options for locating the agent's configuration, shared by all subcommands.
+type cliOptions struct {
+	configDir string
+	logDir    string
+}
+
+func newRootCommand() *cobra.Command {
+	opts := &cliOptions{}
+
+	root := &cobra.Command{
+		Use:           "resim-agent",
+		Short:         "The ReSim Agent runs ReSim jobs on customer-controlled hosts",
+		Version:       agentVersion,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.PersistentFlags().StringVar(&opts.configDir, "config-dir", os.Getenv("RESIM_AGENT_CONFIG_DIR"), "directory to load config.yaml from and cache credentials in")
+	root.PersistentFlags().StringVar(&opts.logDir, "log-dir", os.Getenv("RESIM_AGENT_LOG_DIR"), "directory to write log files to")
+	for _, configFlag := range configFlags {
+		if configFlag.slice {
+			root.PersistentFlags().StringSlice(configFlag.key, nil, configFlag.usage)
+		} else {
+			root.PersistentFlags().String(configFlag.key, "", configFlag.usage)
+		}
+		bindFlag(root.PersistentFlags().Lookup(configFlag.key))
+	}
+
+	// Running the agent is the default, for compatibility with running the binary without arguments
+	run := newRunCommand(opts)
+	root.Flags().AddFlagSet(run.Flags())
+	root.RunE = run.RunE
+
+	root.AddCommand(
+		run,
+		newVersionCommand(),
+		newValidateConfigCommand(opts),
+		newLoginCommand(opts),
+		newUpdateCommand(opts),
+		newCacheCommand(opts),
+		newCtlCommand(opts),
+		newDoctorCommand(opts),
+	)
+	return root
+}
+
+func bindFlag(flag *pflag.Flag) {
+	err := viper.BindPFlag(flag.Name, flag)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// newAgent creates an agent and loads its config, honouring the CLI options.
+func (opts *cliOptions) newAgent() (*Agent, error) {
+	a := New(nil)
+	a.ConfigDirOverride = opts.configDir
+	a.LogDirOverride = opts.logDir
+	err := a.LoadConfig()
+	if err != nil {
+		return a, fmt.Errorf("error loading config: %w", err)
+	}
+	return a, nil
+}
+
+// newAgentOrDefaults creates an agent and loads its config, as newAgent does, but
+// falls back to the defaults and environment if there is no config file, for
+// subcommands that work without one.
+func (opts *cliOptions) newAgentOrDefaults() (*Agent, error) {
+	a, err := opts.newAgent()
+	if !errors.Is(err, fs.ErrNotExist) {
+		return a, err
+	}
+	return opts.newDefaultAgent()
+}
+
+// newDefaultAgent creates an agent with the defaults and environment, without
+// loading its config.
+func (opts *cliOptions) newDefaultAgent() (*Agent, error) {
+	a := New(nil)
+	a.ConfigDirOverride = opts.configDir
+	a.LogDirOverride = opts.logDir
+	// Connect through the proxies in the environment, if there are any
+	a.HTTPConfig = HTTPConfig{Timeout: HTTPTimeoutDefault}
+	var err error
+	a.HTTPClient, err = newHTTPClient(a.HTTPConfig)
+	return a, err
+}
+
+func newRunCommand(opts *cliOptions) *cobra.Command {
+	var printEffectiveConfig bool
+
+	run := &cobra.Command{
+		Use:   "run",
+		Short: "Run the agent",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := opts.newAgent()
+			if err != nil {
+				return err
+			}
+			dockerClient, err := NewDockerClient(a.RuntimeHost)
+			if err != nil {
+				slog.Error("error initializing Docker client", "err", err)
+				return err
+			}
+			defer dockerClient.Close()
+			a.Docker = dockerClient
+
+			if printEffectiveConfig {
+				effectiveConfig, err := a.EffectiveConfig()
+				if err != nil {
+					return fmt.Errorf("error rendering effective config: %w", err)
+				}
+				fmt.Fprint(cmd.OutOrStdout(), string(effectiveConfig))
+				return nil
+			}
+
+			err = a.Start()
+			if a.RemoveExperienceCache {
+				a.DeleteExperienceCache()
+			}
+			return err
+		},
+	}
+	run.Flags().Bool("once", false, "exit after running one worker")
+	err := viper.BindPFlag(OneTaskKey, run.Flags().Lookup("once"))
+	if err != nil {
+		panic(err)
+	}
+	run.Flags().BoolVar(&printEffectiveConfig, "print-effective-config", false, "print the merged configuration, with secrets redacted, and exit")
+	return run
+}
+
+func newVersionCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "version",
+		Short: "Print the agent version",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Fprintln(cmd.OutOrStdout(), agentVersion)
+		},
+	}
+}
+
+func newValidateConfigCommand(opts *cliOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "validate-config",
+		Short: "Check that the agent's configuration is valid",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			_, err := opts.newAgent()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(cmd.OutOrStdout(), "config is valid")
+			return nil
+		},
+	}
+}
+
+func newLoginCommand(opts *cliOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "login",
+		Short: "Check the agent's credentials by logging in to ReSim",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			a, err := opts.newAgent()
+			if err != nil {
+				return err
+			}
+			orgName, err := a.Login()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "logged in to %v as %v\n", orgName, viper.GetString(UsernameKey))
+			return nil
+		},
+	}
+}
+
+func newUpdateCommand(opts *cliOptions) *cobra.Command {
+	var checkOnly bool
+
+	update := &cobra.Command{
+		Use:   "update",
+		Short: "Update the agent to the latest release",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Config is loaded for the proxy, CA bundle and client certificate
+			a, err := opts.newAgentOrDefaults()
+			if err != nil {
+				return err
+			}
+			a.AutoUpdate = !checkOnly
+			return a.checkUpdate()
+		},
+	}
+	update.Flags().BoolVar(&checkOnly, "check", false, "only check whether an update is available")
+	return update
+}
+
+func newCacheCommand(opts *cliOptions) *cobra.Command {
+	cache := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the experience cache",
+	}
+	cache.AddCommand(
+		&cobra.Command{
+			Use:   "info",
+			Short: "Print the location and size of the experience cache",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				a, err := opts.newAgent()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%v: %v MB\n", a.ExperienceCacheDir, dirSize(a.ExperienceCacheDir)/(1024*1024))
+				return nil
+			},
+		},
+		&cobra.Command{
+			Use:   "clear",
+			Short: "Delete the experience cache",
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				a, err := opts.newAgent()
+				if err != nil {
+					return err
+				}
+				a.DeleteExperienceCache()
+				fmt.Fprintf(cmd.OutOrStdout(), "deleted %v\n", a.ExperienceCacheDir)
+				return nil
+			},
+		},
+	)
+	return cache
+}
+
+func newCtlCommand(opts *cliOptions) *cobra.Command {
+	var socket string
+
+	ctl := &cobra.Command{
+		Use:       "ctl {status|pause|resume|drain|cancel}",
+		Short:     "Control a running agent",
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"status", "pause", "resume", "drain", "cancel"},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// The socket is taken from config if there is any, so that ctl finds an
+			// agent with a configured control-socket
+			a, err := opts.newAgentOrDefaults()
+			if err != nil {
+				return err
+			}
+			if socket != "" {
+				a.ControlSocket = socket
+			}
+			return a.runCtl(args[0], cmd.OutOrStdout())
+		},
+	}
+	ctl.Flags().StringVar(&socket, "socket", os.Getenv("RESIM_AGENT_CONTROL_SOCKET"), "path of the agent's control socket")
+	return ctl
+}
+
+func newDoctorCommand(opts *cliOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "doctor",
+		Short: "Check that this host is set up correctly to run the agent",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// A config that doesn't load is reported as one of the checks, and the
+			// others are run with the defaults
+			a, configErr := opts.newAgentOrDefaults()
+			if configErr != nil {
+				var err error
+				a, err = opts.newDefaultAgent()
+				if err != nil {
+					return err
+				}
+			}
+			dockerClient, err := NewDockerClient(a.RuntimeHost)
+			if err != nil {
+				return fmt.Errorf("error initializing Docker client: %w", err)
+			}
+			defer dockerClient.Close()
+			a.Docker = dockerClient
+			results := a.Doctor(context.Background(), configErr)
+			failed := writeDoctorResults(cmd.OutOrStdout(), results)
+			if failed > 0 {
+				return fmt.Errorf("%v of %v checks failed", failed, len(results))
+			}
+			return nil
+		},
+	}
+}
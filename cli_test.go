@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// runCLI runs the agent CLI with the given arguments, returning its output.
+func runCLI(t *testing.T, args ...string) (string, error) {
+	// Flags are bound to the global viper instance, so reset it to avoid leaking them into other tests
+	t.Cleanup(viper.Reset)
+
+	var out bytes.Buffer
+	root := newRootCommand()
+	root.SetOut(&out)
+	root.SetErr(&out)
+	root.SetArgs(args)
+	err := root.Execute()
+	return out.String(), err
+}
+
+func writeCLITestConfig(t *testing.T, content string) string {
+	configDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(configDir, ConfigFilename), []byte(content), 0600)
+	assert.NoError(t, err)
+	return configDir
+}
+
+func TestCLIVersion(t *testing.T) {
+	out, err := runCLI(t, "version")
+	assert.NoError(t, err)
+	assert.Equal(t, agentVersion+"\n", out)
+}
+
+func TestCLIValidateConfig(t *testing.T) {
+	configDir := writeCLITestConfig(t, `
+name: test-agent
+pool-labels:
+  - small
+`)
+
+	out, err := runCLI(t, "validate-config", "--config-dir", configDir)
+	assert.NoError(t, err)
+	assert.Equal(t, "config is valid\n", out)
+
+	_, err = runCLI(t, "validate-config", "--config-dir", configDir, "--log-format", "xml")
+	assert.ErrorContains(t, err, "invalid log format")
+
+	configDir = writeCLITestConfig(t, `
+pool-labels:
+  - small
+`)
+	_, err = runCLI(t, "validate-config", "--config-dir", configDir)
+	assert.ErrorContains(t, err, "agent name must be set")
+}
+
+func TestCLIFlagsOverrideConfig(t *testing.T) {
+	configDir := writeCLITestConfig(t, `
+name: test-agent
+pool-labels:
+  - small
+username: gimli
+password: hunter2
+`)
+
+	out, err := runCLI(t, "run", "--config-dir", configDir, "--name", "flag-agent", "--pool-labels", "gpu,arm64", "--once", "--print-effective-config")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "name: flag-agent")
+	assert.Contains(t, out, "- gpu\n")
+	assert.Contains(t, out, "- arm64\n")
+	assert.NotContains(t, out, "- small\n")
+	assert.Contains(t, out, "one-task: true")
+	assert.NotContains(t, out, "hunter2")
+}
+
+func TestCLICtlUsesConfiguredSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "control.sock")
+	configDir := writeCLITestConfig(t, `
+name: test-agent
+pool-labels:
+  - small
+control-socket: `+socketPath+`
+`)
+
+	_, err := runCLI(t, "ctl", "status", "--config-dir", configDir)
+	assert.ErrorContains(t, err, "error connecting to agent at "+socketPath)
+
+	// The flag overrides config
+	flagSocketPath := filepath.Join(t.TempDir(), "flag.sock")
+	_, err = runCLI(t, "ctl", "status", "--config-dir", configDir, "--socket", flagSocketPath)
+	assert.ErrorContains(t, err, "error connecting to agent at "+flagSocketPath)
+
+	// Without a config file, the socket in the config directory is used
+	emptyConfigDir := t.TempDir()
+	_, err = runCLI(t, "ctl", "status", "--config-dir", emptyConfigDir)
+	assert.ErrorContains(t, err, "error connecting to agent at "+filepath.Join(emptyConfigDir, ControlSocketFilename))
+}
+
+func TestCLINewAgentOrDefaults(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	configDir := writeCLITestConfig(t, `
+name: test-agent
+pool-labels:
+  - small
+https-proxy: http://proxy.example.com:8080
+`)
+	a, err := (&cliOptions{configDir: configDir}).newAgentOrDefaults()
+	assert.NoError(t, err)
+	assert.Equal(t, "http://proxy.example.com:8080", a.HTTPConfig.HTTPSProxy, "config is used for the update client")
+
+	// Without a config file, the defaults and environment are used
+	viper.Reset()
+	emptyConfigDir := t.TempDir()
+	a, err = (&cliOptions{configDir: emptyConfigDir}).newAgentOrDefaults()
+	assert.NoError(t, err)
+	assert.Equal(t, emptyConfigDir, a.ConfigDirOverride)
+	assert.Equal(t, HTTPTimeoutDefault, a.HTTPClient.Timeout)
+
+	configDir = writeCLITestConfig(t, `
+name: test-agent
+log-format: xml
+`)
+	_, err = (&cliOptions{configDir: configDir}).newAgentOrDefaults()
+	assert.ErrorContains(t, err, "invalid log format", "invalid config is still an error")
+}
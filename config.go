@@ -3,19 +3,20 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
-	"log"
 	"log/slog"
 	"os"
 	"os/user"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
-	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v3"
 )
 
+const redactedValue = "REDACTED"
+
 type DockerNetworkMode string
 
 const (
@@ -37,12 +38,79 @@ const (
 	LogLevelKey                      = "log-level"
 	LogFilesizeKey                   = "log-max-filesize"
 	LogFilesizeDefault               = 500
+	LogMaxBackupsKey                 = "log-max-backups"
+	LogMaxBackupsDefault             = 3
+	LogMaxAgeKey                     = "log-max-age"
+	LogMaxAgeDefault                 = 28
+	LogCompressKey                   = "log-compress"
+	LogCompressDefault               = true
+	LogFormatKey                     = "log-format"
+	LogFormatDefault                 = string(LogFormatText)
+	LogDestinationsKey               = "log-destinations"
+	LogSyslogAddressKey              = "log-syslog-address"
+	HTTPListenAddressKey             = "http-listen-address"
+	HealthCheckinTimeoutKey          = "health-checkin-timeout"
+	HealthCheckinTimeoutDefault      = 5 * time.Minute
+	HealthProgressTimeoutKey         = "health-progress-timeout"
+	HealthProgressTimeoutDefault     = 15 * time.Minute
+	HealthMinFreeDiskMBKey           = "health-min-free-disk-mb"
+	HealthMinFreeDiskMBDefault       = 1024
+	ControlAPIKey                    = "control-api"
+	ControlAPIDefault                = true
+	ControlSocketKey                 = "control-socket"
+	TracingEndpointKey               = "tracing-endpoint"
+	ContainerisedKey                 = "containerised"
+	ContainerisedDefault             = false
+	ContainerIDKey                   = "container-id"
+	ContainerRuntimeSocketKey        = "container-runtime-socket"
+	PlatformKey                      = "platform"
+	ImagePullPolicyKey               = "image-pull-policy"
+	ImagePullPolicyDefault           = string(ImagePullPolicyAlways)
+	ImageRetentionCountKey           = "image-retention-count"
+	ImageRetentionCountDefault       = 3
+	ImageGCDiskThresholdKey          = "image-gc-disk-threshold"
+	ImageGCDiskThresholdDefault      = 85
+	RegistryCredentialsKey           = "registry-credentials"
+	HTTPProxyKey                     = "http-proxy"
+	HTTPSProxyKey                    = "https-proxy"
+	NoProxyKey                       = "no-proxy"
+	CABundleKey                      = "ca-bundle"
+	ClientCertificateKey             = "client-certificate"
+	ClientKeyKey                     = "client-key"
+	HTTPTimeoutKey                   = "http-timeout"
+	HTTPTimeoutDefault               = time.Minute
+	PreTaskHooksKey                  = "pre-task-hooks"
+	PostTaskHooksKey                 = "post-task-hooks"
+	HookTimeoutKey                   = "hook-timeout"
+	HookTimeoutDefault               = 5 * time.Minute
+	PreTaskHookFailureUnhealthyKey   = "pre-task-hook-failure-unhealthy"
+	HealthProbesKey                  = "health-probes"
+	HealthProbeIntervalKey           = "health-probe-interval"
+	HealthProbeIntervalDefault       = 30 * time.Second
+	HealthProbeTimeoutKey            = "health-probe-timeout"
+	HealthProbeTimeoutDefault        = 10 * time.Second
+	HostFactPoolLabelsKey            = "host-fact-pool-labels"
+	DevicePoolLabelsKey              = "device-pool-labels"
+	PoolLabelScriptsKey              = "pool-label-scripts"
+	PoolLabelScriptTimeoutKey        = "pool-label-script-timeout"
+	PoolLabelScriptTimeoutDefault    = 30 * time.Second
+	PoolLabelsRefreshIntervalKey     = "pool-labels-refresh-interval"
+	PoolLabelsRefreshIntervalDefault = 5 * time.Minute
 	AutoUpdateKey                    = "auto-update"
 	PrivilegedKey                    = "privileged"
 	PrivilegedDefault                = false
 	NetworkModeKey                   = "docker-network-mode"
 	NetworkModeDefault               = string(DockerNetworkModeBridge)
+	NetworkSubnetKey                 = "docker-network-subnet"
+	NetworkGatewayKey                = "docker-network-gateway"
+	DNSServersKey                    = "dns-servers"
+	DNSSearchDomainsKey              = "dns-search-domains"
+	ExtraHostsKey                    = "extra-hosts"
 	ConfigPath                       = "$HOME/resim"
+	ConfigFilename                   = "config.yaml"
+	DropInDirName                    = "config.d"
+	ListMergeKey                     = "list-merge"
+	RedactPatternsKey                = "redact-patterns"
 	CredentialCacheFilename          = "cache.json"
 	CustomerContainerAWSDestDirKey   = "aws-config-destination-dir"
 	CustomerContainerAWSSourceDirKey = "aws-config-source-dir"
@@ -54,6 +122,9 @@ const (
 	AgentErrorSleepDefault           = 5 * time.Second
 	WorkerExitSleepKey               = "worker-exit-sleep"
 	WorkerExitSleepDefault           = 30 * time.Second
+	WorkerMaxRuntimeKey              = "worker-max-runtime"
+	WorkerStopGracePeriodKey         = "worker-stop-grace-period"
+	WorkerStopGracePeriodDefault     = 30 * time.Second
 	RemoveWorkerDirKey               = "remove-worker-dir"
 	RemoveWorkerDirDefault           = true
 	RemoveExperienceCacheKey         = "remove-experience-cache"
@@ -63,9 +134,12 @@ const (
 )
 
 type CustomWorkerConfig struct {
-	Mounts   []Mount  `json:"mounts"`
-	EnvVars  []EnvVar `json:"envvars"`
-	CacheDir string   `json:"cache_dir"`
+	Mounts     []Mount  `json:"mounts"`
+	EnvVars    []EnvVar `json:"envvars"`
+	CacheDir   string   `json:"cache_dir"`
+	DNS        []string `json:"dns,omitempty"`
+	DNSSearch  []string `json:"dns_search,omitempty"`
+	ExtraHosts []string `json:"extra_hosts,omitempty"`
 }
 
 type Mount struct {
@@ -78,13 +152,17 @@ type EnvVar struct {
 	Value string `json:"value"`
 }
 
+// parseNetworkMode parses the network mode: bridge, host, or the name of a
+// user-defined network.
 func parseNetworkMode(mode string) (DockerNetworkMode, error) {
 	switch DockerNetworkMode(mode) {
 	case DockerNetworkModeBridge, DockerNetworkModeHost:
 		return DockerNetworkMode(mode), nil
-	default:
+	}
+	if mode == "none" || !networkNamePattern.MatchString(mode) {
 		return DockerNetworkModeBridge, errors.New("invalid network mode")
 	}
+	return DockerNetworkMode(mode), nil
 }
 
 // GetHostAWSConfigDir returns the absolute path to an expected host AWS config dir
@@ -116,17 +194,26 @@ func (a *Agent) LoadConfig() error {
 		slog.Error("error getting config dir", "err", err)
 		return err
 	}
-	viper.SetConfigFile(filepath.Join(configDir, "config.yaml"))
+	viper.SetConfigFile(filepath.Join(configDir, ConfigFilename))
 
 	err = viper.ReadInConfig() // Find and read the config file
 	if err != nil {            // Handle errors reading the config file
 		return err
 	}
 
+	err = mergeDropInConfigs(configDir)
+	if err != nil {
+		slog.Error("error merging drop-in config", "err", err)
+		return err
+	}
+
 	viper.SetEnvPrefix(EnvPrefix)
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 
+	// Configured redact patterns are in addition to the defaults, never instead of them
+	a.Redactor = NewRedactor(append(slices.Clone(DefaultRedactPatterns), viper.GetStringSlice(RedactPatternsKey)...))
+
 	viper.SetDefault(LogLevelKey, "info")
 	a.LogLevel = viper.GetString(LogLevelKey)
 
@@ -134,6 +221,21 @@ func (a *Agent) LoadConfig() error {
 	a.AutoUpdate = viper.GetBool(AutoUpdateKey)
 
 	viper.SetDefault(LogFilesizeKey, LogFilesizeDefault)
+	viper.SetDefault(LogMaxBackupsKey, LogMaxBackupsDefault)
+	viper.SetDefault(LogMaxAgeKey, LogMaxAgeDefault)
+	viper.SetDefault(LogCompressKey, LogCompressDefault)
+
+	viper.SetDefault(LogFormatKey, LogFormatDefault)
+	a.LogFormat, err = parseLogFormat(viper.GetString(LogFormatKey))
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(LogDestinationsKey, LogDestinationsDefault)
+	a.LogDestinations, err = parseLogDestinations(viper.GetStringSlice(LogDestinationsKey))
+	if err != nil {
+		return err
+	}
 
 	viper.SetDefault(PrivilegedKey, PrivilegedDefault)
 	a.Privileged = viper.GetBool(PrivilegedKey)
@@ -141,7 +243,28 @@ func (a *Agent) LoadConfig() error {
 	viper.SetDefault(NetworkModeKey, NetworkModeDefault)
 	a.DockerNetworkMode, err = parseNetworkMode(viper.GetString(NetworkModeKey))
 	if err != nil {
-		log.Fatalf("Agent only supports %v or %v for docker network mode", DockerNetworkModeBridge, DockerNetworkModeHost)
+		return fmt.Errorf("agent only supports %v, %v or the name of a network for docker network mode", DockerNetworkModeBridge, DockerNetworkModeHost)
+	}
+	a.DockerNetworkSubnet = viper.GetString(NetworkSubnetKey)
+	a.DockerNetworkGateway = viper.GetString(NetworkGatewayKey)
+	err = validateNetworkSubnet(a.DockerNetworkSubnet, a.DockerNetworkGateway)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", NetworkSubnetKey, err)
+	}
+	if a.DockerNetworkSubnet != "" && !a.DockerNetworkMode.isCustom() {
+		return fmt.Errorf("%v only applies to a network the agent creates, set with %v", NetworkSubnetKey, NetworkModeKey)
+	}
+	a.CustomerWorkerConfig.DNS, err = parseDNSServers(viper.GetStringSlice(DNSServersKey))
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", DNSServersKey, err)
+	}
+	a.CustomerWorkerConfig.DNSSearch = viper.GetStringSlice(DNSSearchDomainsKey)
+	if a.DockerNetworkMode == DockerNetworkModeHost && (len(a.CustomerWorkerConfig.DNS) > 0 || len(a.CustomerWorkerConfig.DNSSearch) > 0) {
+		return fmt.Errorf("%v and %v can't be used with the %v network mode", DNSServersKey, DNSSearchDomainsKey, DockerNetworkModeHost)
+	}
+	a.CustomerWorkerConfig.ExtraHosts, err = parseExtraHosts(viper.GetStringSlice(ExtraHostsKey))
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", ExtraHostsKey, err)
 	}
 
 	viper.SetDefault(APIHostKey, APIHostDefault)
@@ -159,12 +282,12 @@ func (a *Agent) LoadConfig() error {
 	}
 
 	if !viper.IsSet(AgentNameKey) {
-		log.Fatal("Agent name must be set")
+		return errors.New("agent name must be set")
 	}
 	a.Name = viper.GetString(AgentNameKey)
 
 	if !viper.IsSet(PoolLabelsKey) {
-		log.Fatal("Pool labels must be set")
+		return errors.New("pool labels must be set")
 	}
 	a.PoolLabels = viper.GetStringSlice(PoolLabelsKey)
 
@@ -174,7 +297,7 @@ func (a *Agent) LoadConfig() error {
 		for _, mount := range mountsString {
 			mountParts := strings.Split(mount, ":")
 			if len(mountParts) != 2 {
-				log.Fatal("Invalid mount format: must be <source>:<target>")
+				return fmt.Errorf("invalid mount format %q: must be <source>:<target>", mount)
 			}
 			a.CustomerWorkerConfig.Mounts = append(a.CustomerWorkerConfig.Mounts, Mount{Source: mountParts[0], Target: mountParts[1]})
 		}
@@ -219,7 +342,7 @@ func (a *Agent) LoadConfig() error {
 		for _, envVar := range envVarsString {
 			envVarParts := strings.Split(envVar, "=")
 			if len(envVarParts) != 2 {
-				log.Fatal("Invalid environment variable format: must be <key>=<value>")
+				return errors.New("invalid environment variable format: must be <key>=<value>")
 			}
 			a.CustomerWorkerConfig.EnvVars = append(a.CustomerWorkerConfig.EnvVars, EnvVar{Key: envVarParts[0], Value: envVarParts[1]})
 		}
@@ -234,6 +357,10 @@ func (a *Agent) LoadConfig() error {
 	viper.SetDefault(WorkerExitSleepKey, WorkerExitSleepDefault)
 	a.WorkerExitSleep = viper.GetDuration(WorkerExitSleepKey)
 
+	a.WorkerMaxRuntime = viper.GetDuration(WorkerMaxRuntimeKey)
+	viper.SetDefault(WorkerStopGracePeriodKey, WorkerStopGracePeriodDefault)
+	a.WorkerStopGracePeriod = viper.GetDuration(WorkerStopGracePeriodKey)
+
 	viper.SetDefault(RemoveWorkerDirKey, RemoveWorkerDirDefault)
 	a.RemoveWorkerDir = viper.GetBool(RemoveWorkerDirKey)
 
@@ -244,6 +371,140 @@ func (a *Agent) LoadConfig() error {
 	a.ExperienceCacheDir = viper.GetString(ExperienceCacheDirKey)
 	a.CustomerWorkerConfig.CacheDir = viper.GetString(ExperienceCacheDirKey)
 
+	a.HTTPListenAddress = viper.GetString(HTTPListenAddressKey)
+
+	viper.SetDefault(HealthCheckinTimeoutKey, HealthCheckinTimeoutDefault)
+	a.HealthCheckinTimeout = viper.GetDuration(HealthCheckinTimeoutKey)
+
+	viper.SetDefault(HealthProgressTimeoutKey, HealthProgressTimeoutDefault)
+	a.HealthProgressTimeout = viper.GetDuration(HealthProgressTimeoutKey)
+
+	viper.SetDefault(HealthMinFreeDiskMBKey, HealthMinFreeDiskMBDefault)
+	a.HealthMinFreeDiskMB = viper.GetUint64(HealthMinFreeDiskMBKey)
+
+	a.TracingEndpoint = viper.GetString(TracingEndpointKey)
+
+	viper.SetDefault(ControlAPIKey, ControlAPIDefault)
+	a.ControlAPI = viper.GetBool(ControlAPIKey)
+	a.ControlSocket = viper.GetString(ControlSocketKey)
+
+	viper.SetDefault(ContainerisedKey, ContainerisedDefault)
+	a.Containerised = viper.GetBool(ContainerisedKey)
+	a.ContainerID = viper.GetString(ContainerIDKey)
+	a.RuntimeHost = detectRuntimeHost(viper.GetString(ContainerRuntimeSocketKey), runtimeSocketCandidates())
+
+	if viper.IsSet(PlatformKey) {
+		a.Platform, err = parsePlatform(viper.GetString(PlatformKey))
+		if err != nil {
+			return err
+		}
+	}
+
+	viper.SetDefault(ImagePullPolicyKey, ImagePullPolicyDefault)
+	a.ImagePullPolicy, err = parseImagePullPolicy(viper.GetString(ImagePullPolicyKey))
+	if err != nil {
+		return err
+	}
+
+	viper.SetDefault(ImageRetentionCountKey, ImageRetentionCountDefault)
+	a.ImageRetentionCount = viper.GetInt(ImageRetentionCountKey)
+	viper.SetDefault(ImageGCDiskThresholdKey, ImageGCDiskThresholdDefault)
+	a.ImageGCDiskThreshold = viper.GetInt(ImageGCDiskThresholdKey)
+	if a.ImageGCDiskThreshold < 0 || a.ImageGCDiskThreshold > 100 {
+		return fmt.Errorf("invalid %v %v: must be a percentage between 0 and 100", ImageGCDiskThresholdKey, a.ImageGCDiskThreshold)
+	}
+
+	var registryCredentials []RegistryCredential
+	err = viper.UnmarshalKey(RegistryCredentialsKey, &registryCredentials)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", RegistryCredentialsKey, err)
+	}
+	for _, credential := range registryCredentials {
+		if credential.Registry == "" || (credential.Helper == "" && credential.Username == "") {
+			return fmt.Errorf("invalid %v: each must have a registry, and a username and password or a helper", RegistryCredentialsKey)
+		}
+	}
+	a.RegistryAuthenticator = NewRegistryAuthenticator(registryCredentials, defaultDockerConfigPath())
+
+	viper.SetDefault(HTTPTimeoutKey, HTTPTimeoutDefault)
+	a.HTTPConfig = HTTPConfig{
+		HTTPProxy:         viper.GetString(HTTPProxyKey),
+		HTTPSProxy:        viper.GetString(HTTPSProxyKey),
+		NoProxy:           viper.GetString(NoProxyKey),
+		CABundle:          viper.GetString(CABundleKey),
+		ClientCertificate: viper.GetString(ClientCertificateKey),
+		ClientKey:         viper.GetString(ClientKeyKey),
+		Timeout:           viper.GetDuration(HTTPTimeoutKey),
+	}
+	a.HTTPClient, err = newHTTPClient(a.HTTPConfig)
+	if err != nil {
+		return fmt.Errorf("invalid HTTP client config: %w", err)
+	}
+
+	for key, hooks := range map[string]*[]TaskHook{PreTaskHooksKey: &a.PreTaskHooks, PostTaskHooksKey: &a.PostTaskHooks} {
+		*hooks = nil
+		err = viper.UnmarshalKey(key, hooks)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %w", key, err)
+		}
+		err = validateTaskHooks(*hooks)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %w", key, err)
+		}
+	}
+	viper.SetDefault(HookTimeoutKey, HookTimeoutDefault)
+	a.HookTimeout = viper.GetDuration(HookTimeoutKey)
+	if a.HookTimeout <= 0 {
+		return fmt.Errorf("%v must be positive", HookTimeoutKey)
+	}
+	a.PreTaskHookFailureUnhealthy = viper.GetBool(PreTaskHookFailureUnhealthyKey)
+
+	a.HealthProbes = nil
+	err = viper.UnmarshalKey(HealthProbesKey, &a.HealthProbes)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", HealthProbesKey, err)
+	}
+	err = validateHealthProbes(a.HealthProbes)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", HealthProbesKey, err)
+	}
+	viper.SetDefault(HealthProbeIntervalKey, HealthProbeIntervalDefault)
+	viper.SetDefault(HealthProbeTimeoutKey, HealthProbeTimeoutDefault)
+	a.HealthProbeInterval = viper.GetDuration(HealthProbeIntervalKey)
+	a.HealthProbeTimeout = viper.GetDuration(HealthProbeTimeoutKey)
+	if len(a.HealthProbes) > 0 && a.HealthProbeInterval <= 0 {
+		return fmt.Errorf("%v must be positive", HealthProbeIntervalKey)
+	}
+	if a.HealthProbeTimeout <= 0 {
+		return fmt.Errorf("%v must be positive", HealthProbeTimeoutKey)
+	}
+
+	a.HostFactPoolLabels = viper.GetBool(HostFactPoolLabelsKey)
+	a.DevicePoolLabels = nil
+	err = viper.UnmarshalKey(DevicePoolLabelsKey, &a.DevicePoolLabels)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", DevicePoolLabelsKey, err)
+	}
+	a.PoolLabelScripts = nil
+	err = viper.UnmarshalKey(PoolLabelScriptsKey, &a.PoolLabelScripts)
+	if err != nil {
+		return fmt.Errorf("invalid %v: %w", PoolLabelScriptsKey, err)
+	}
+	err = validateDynamicPoolLabels(a.DevicePoolLabels, a.PoolLabelScripts)
+	if err != nil {
+		return fmt.Errorf("invalid dynamic pool labels: %w", err)
+	}
+	viper.SetDefault(PoolLabelScriptTimeoutKey, PoolLabelScriptTimeoutDefault)
+	a.PoolLabelScriptTimeout = viper.GetDuration(PoolLabelScriptTimeoutKey)
+	if a.PoolLabelScriptTimeout <= 0 {
+		return fmt.Errorf("%v must be positive", PoolLabelScriptTimeoutKey)
+	}
+	viper.SetDefault(PoolLabelsRefreshIntervalKey, PoolLabelsRefreshIntervalDefault)
+	a.PoolLabelsRefreshInterval = viper.GetDuration(PoolLabelsRefreshIntervalKey)
+	if a.hasDynamicPoolLabels() && a.PoolLabelsRefreshInterval <= 0 {
+		return fmt.Errorf("%v must be positive", PoolLabelsRefreshIntervalKey)
+	}
+
 	slog.Info("loaded config",
 		"apiHost", a.APIHost,
 		"authHost", a.AuthHost,
@@ -251,56 +512,123 @@ func (a *Agent) LoadConfig() error {
 		"poolLabels", a.PoolLabels,
 		"privileged", a.Privileged,
 		"dockerNetworkMode", a.DockerNetworkMode,
+		"dnsServers", a.CustomerWorkerConfig.DNS,
+		"dnsSearchDomains", a.CustomerWorkerConfig.DNSSearch,
+		"extraHosts", a.CustomerWorkerConfig.ExtraHosts,
 		"mounts", a.CustomerWorkerConfig.Mounts,
-		"envVars", a.CustomerWorkerConfig.EnvVars,
+		"envVars", a.Redactor.RedactCustomEnvVars(a.CustomerWorkerConfig.EnvVars),
 		"cacheDir", a.CustomerWorkerConfig.CacheDir,
 		"one_task", viper.GetBool(OneTaskKey),
+		"containerised", a.Containerised,
+		"runtimeHost", a.RuntimeHost,
+		"imagePullPolicy", a.ImagePullPolicy,
+		"imageRetentionCount", a.ImageRetentionCount,
+		"httpProxy", redactProxyURL(a.HTTPConfig.HTTPProxy),
+		"httpsProxy", redactProxyURL(a.HTTPConfig.HTTPSProxy),
+		"noProxy", a.HTTPConfig.NoProxy,
+		"caBundle", a.HTTPConfig.CABundle,
+		"clientCertificate", a.HTTPConfig.ClientCertificate,
 	)
 
 	return nil
 }
 
-func (a *Agent) InitializeLogging() error {
-	var logDir string
-	if a.LogDirOverride != "" {
-		logDir = a.LogDirOverride
-	} else {
-		userHomeDir, _ := os.UserHomeDir()
-		logDir = filepath.Join(userHomeDir, "resim")
+type ListMergeMode string
+
+const (
+	ListMergeModeAppend  ListMergeMode = "append"
+	ListMergeModeReplace ListMergeMode = "replace"
+)
+
+// listMergeKeys are the config keys whose values are combined across drop-in
+// files according to the drop-in's list-merge mode; all other keys are replaced.
+var listMergeKeys = []string{VolumeMountsKey, EnvVarsKey, PoolLabelsKey}
+
+// mergeDropInConfigs layers any config.d/*.yaml files, in lexical order, on top
+// of the base config file that viper has already read.
+func mergeDropInConfigs(configDir string) error {
+	dropIns, err := filepath.Glob(filepath.Join(configDir, DropInDirName, "*.yaml"))
+	if err != nil {
+		return err
 	}
-	logFileWriter := &lumberjack.Logger{
-		Filename:   fmt.Sprintf("%v/agent.log", logDir),
-		MaxSize:    viper.GetInt(LogFilesizeKey),
-		MaxBackups: 3,
-		MaxAge:     28,
-		Compress:   true,
+	if len(dropIns) == 0 {
+		return nil
 	}
 
-	// test write to check permissions on the file
-	_, err := fmt.Fprintf(logFileWriter, "ReSim Agent %v", agentVersion)
+	// Re-read the base file into its own map so that the merged lists are not
+	// polluted by values from the environment
+	settings, err := readConfigSettings(viper.ConfigFileUsed())
 	if err != nil {
 		return err
 	}
+	for _, dropIn := range dropIns {
+		dropInSettings, err := readConfigSettings(dropIn)
+		if err != nil {
+			return err
+		}
+		err = mergeConfigSettings(settings, dropInSettings)
+		if err != nil {
+			return fmt.Errorf("%v: %w", dropIn, err)
+		}
+		slog.Debug("merged drop-in config", "path", dropIn)
+	}
+	return viper.MergeConfigMap(settings)
+}
 
-	var slogLevel slog.Level
-	switch a.LogLevel {
-	case "debug":
-		slogLevel = slog.LevelDebug
-	case "info":
-		slogLevel = slog.LevelInfo
-	case "error":
-		slogLevel = slog.LevelError
-	case "warn":
-		slogLevel = slog.LevelWarn
-	default:
-		slog.Warn("invalid log level set in config")
-		slogLevel = slog.LevelDebug
+func readConfigSettings(path string) (map[string]any, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, err
 	}
+	return v.AllSettings(), nil
+}
 
-	logWriters := io.MultiWriter(os.Stdout, logFileWriter)
-	logHandler := slog.NewTextHandler(logWriters, &slog.HandlerOptions{Level: slogLevel})
-	logger := slog.New(logHandler)
-	slog.SetDefault(logger)
+// mergeConfigSettings merges src into dst. List keys are appended to unless src
+// sets list-merge to replace.
+func mergeConfigSettings(dst map[string]any, src map[string]any) error {
+	mode := ListMergeModeAppend
+	if rawMode, ok := src[ListMergeKey]; ok {
+		mode = ListMergeMode(fmt.Sprint(rawMode))
+		delete(src, ListMergeKey)
+	}
+	switch mode {
+	case ListMergeModeAppend, ListMergeModeReplace:
+	default:
+		return fmt.Errorf("invalid %v %q: must be %v or %v", ListMergeKey, mode, ListMergeModeAppend, ListMergeModeReplace)
+	}
 
+	for key, value := range src {
+		if mode == ListMergeModeAppend && slices.Contains(listMergeKeys, key) {
+			dst[key] = append(toSlice(dst[key]), toSlice(value)...)
+		} else {
+			dst[key] = value
+		}
+	}
 	return nil
 }
+
+func toSlice(value any) []any {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		return v
+	default:
+		return []any{v}
+	}
+}
+
+// EffectiveConfig renders the fully merged configuration (files, drop-ins,
+// environment and defaults) as YAML, with secrets redacted.
+func (a *Agent) EffectiveConfig() ([]byte, error) {
+	settings := a.Redactor.RedactSettings(viper.AllSettings())
+	// Proxy URLs may contain a password, which their keys don't suggest
+	for _, key := range []string{HTTPProxyKey, HTTPSProxyKey} {
+		if proxy, ok := settings[key].(string); ok {
+			settings[key] = redactProxyURL(proxy)
+		}
+	}
+	return yaml.Marshal(settings)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// DockerSocketPath is where the agent, and the worker, expect the Docker socket.
+const DockerSocketPath = "/var/run/docker.sock"
+
+// hostPathMapping maps a path in the agent's container to the host path mounted there.
+type hostPathMapping struct {
+	containerPath string
+	hostPath      string
+}
+
+// HostPathTranslator translates paths in the agent's container to paths on the
+// host, so that they can be bind mounted into the worker by the host's Docker daemon.
+type HostPathTranslator struct {
+	mappings []hostPathMapping
+}
+
+func NewHostPathTranslator(mounts []types.MountPoint) *HostPathTranslator {
+	t := &HostPathTranslator{}
+	for _, m := range mounts {
+		if m.Type != mount.TypeBind && m.Type != mount.TypeVolume {
+			continue
+		}
+		t.mappings = append(t.mappings, hostPathMapping{
+			containerPath: filepath.Clean(m.Destination),
+			hostPath:      filepath.Clean(m.Source),
+		})
+	}
+	// Match the most specific mount first, in case mounts are nested
+	sort.Slice(t.mappings, func(i, j int) bool {
+		return len(t.mappings[i].containerPath) > len(t.mappings[j].containerPath)
+	})
+	return t
+}
+
+// HostPath returns the host path for path, which must be on one of the
+// container's bind mounts or volumes.
+func (t *HostPathTranslator) HostPath(path string) (string, error) {
+	path = filepath.Clean(path)
+	for _, m := range t.mappings {
+		if path == m.containerPath {
+			return m.hostPath, nil
+		}
+		if rest, ok := strings.CutPrefix(path, m.containerPath+"/"); ok {
+			return filepath.Join(m.hostPath, rest), nil
+		}
+		if m.containerPath == "/" {
+			return filepath.Join(m.hostPath, path), nil
+		}
+	}
+	return "", fmt.Errorf("%v is not mounted from the host into the agent's container", path)
+}
+
+// ownContainerID returns the ID or name of the container the agent is running in.
+// Docker sets the hostname to the short container ID unless it is overridden, in
+// which case container-id must be configured.
+func (a *Agent) ownContainerID() (string, error) {
+	if a.ContainerID != "" {
+		return a.ContainerID, nil
+	}
+	return os.Hostname()
+}
+
+// discoverHostPaths inspects the agent's own container to find where its mounts
+// come from on the host.
+func (a *Agent) discoverHostPaths(ctx context.Context) error {
+	containerID, err := a.ownContainerID()
+	if err != nil {
+		return fmt.Errorf("error finding the agent's container ID: %w", err)
+	}
+	self, err := a.Docker.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("error inspecting the agent's container %v (set container-id if its hostname has been changed): %w", containerID, err)
+	}
+	a.HostPaths = NewHostPathTranslator(self.Mounts)
+
+	// The worker can't run without these, so fail now rather than on the first task
+	requiredPaths := []string{a.WorkerDir, a.ExperienceCacheDir}
+	if socketPath, isUnix := a.runtimeSocketPath(); isUnix {
+		requiredPaths = append(requiredPaths, socketPath)
+	}
+	for _, path := range requiredPaths {
+		hostPath, err := a.hostPath(path)
+		if err != nil {
+			return err
+		}
+		slog.Info("Found host path for mount", "path", path, "host_path", hostPath)
+	}
+
+	// The worker runs without these, but without the host's registry or AWS
+	// credentials, which is easy to miss until a task needs them
+	optionalPaths := []string{dockerConfigDir()}
+	if a.HostAWSConfigExists {
+		optionalPaths = append(optionalPaths, a.HostAWSConfigDir)
+	}
+	for _, path := range optionalPaths {
+		_, err := a.hostPath(path)
+		if err != nil {
+			slog.Warn("Config directory isn't mounted into the agent's container, so won't be mounted into the worker", "path", path, "err", err)
+		}
+	}
+	return nil
+}
+
+// hostPath returns the host path for a path in the agent's environment; when the
+// agent is not containerised, they are the same.
+func (a *Agent) hostPath(path string) (string, error) {
+	if a.HostPaths == nil {
+		return path, nil
+	}
+	return a.HostPaths.HostPath(path)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/yaml.v3"
+)
+
+func TestHostPathTranslator(t *testing.T) {
+	translator := NewHostPathTranslator([]types.MountPoint{
+		{Type: mount.TypeBind, Source: "/run/user/1000/docker.sock", Destination: "/var/run/docker.sock"},
+		{Type: mount.TypeBind, Source: "/data/resim", Destination: "/tmp/resim"},
+		{Type: mount.TypeVolume, Source: "/var/lib/docker/volumes/cache/_data", Destination: "/tmp/resim/cache"},
+		{Type: mount.TypeTmpfs, Destination: "/scratch"},
+	})
+
+	for path, expected := range map[string]string{
+		"/var/run/docker.sock":     "/run/user/1000/docker.sock",
+		"/tmp/resim":               "/data/resim",
+		"/tmp/resim/":              "/data/resim",
+		"/tmp/resim/worker-1/logs": "/data/resim/worker-1/logs",
+		"/tmp/resim/cache":         "/var/lib/docker/volumes/cache/_data",
+		"/tmp/resim/cache/exp":     "/var/lib/docker/volumes/cache/_data/exp",
+	} {
+		hostPath, err := translator.HostPath(path)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, hostPath, path)
+	}
+
+	for _, path := range []string{"/tmp/resimulation", "/scratch", "/root/.aws"} {
+		_, err := translator.HostPath(path)
+		assert.ErrorContains(t, err, "is not mounted from the host", path)
+	}
+}
+
+func TestDiscoverHostPaths(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Containerised = true
+	a.ContainerID = "resim-agent"
+	a.HostAWSConfigExists = true
+	a.HostAWSConfigDir = "/root/.aws"
+	a.ExperienceCacheDir = ExperienceCacheDirDefault
+
+	self := types.ContainerJSON{Mounts: []types.MountPoint{
+		{Type: mount.TypeBind, Source: "/var/run/docker.sock", Destination: DockerSocketPath},
+		{Type: mount.TypeBind, Source: "/srv/resim", Destination: TmpResim},
+		{Type: mount.TypeBind, Source: "/home/ubuntu/.aws", Destination: "/root/.aws"},
+	}}
+	mockDocker.On("ContainerInspect", mock.Anything, "resim-agent").Return(self, nil).Once()
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	assert.NoError(t, a.discoverHostPaths(context.Background()))
+	assert.Contains(t, logs.String(), "Config directory isn't mounted into the agent's container")
+	assert.Contains(t, logs.String(), "path="+dockerConfigDir())
+	assert.NotContains(t, logs.String(), "path=/root/.aws")
+
+	mounts, err := a.workerMounts()
+	assert.NoError(t, err)
+	sources := map[string]string{}
+	for _, m := range mounts {
+		sources[m.Target] = m.Source
+	}
+	assert.Equal(t, map[string]string{
+		DockerSocketPath:   "/var/run/docker.sock",
+		TmpResim:           "/srv/resim",
+		"/tmp/resim/cache": "/srv/resim/cache",
+		"/root/.aws":       "/home/ubuntu/.aws",
+	}, sources, "Docker config is not mounted into the agent's container, so is not mounted into the worker")
+}
+
+func TestDiscoverHostPathsMissingMount(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.ContainerID = "resim-agent"
+
+	mockDocker.On("ContainerInspect", mock.Anything, "resim-agent").Return(types.ContainerJSON{Mounts: []types.MountPoint{
+		{Type: mount.TypeBind, Source: "/var/run/docker.sock", Destination: DockerSocketPath},
+	}}, nil).Once()
+	assert.ErrorContains(t, a.discoverHostPaths(context.Background()), "/tmp/resim is not mounted")
+
+	mockDocker.On("ContainerInspect", mock.Anything, "resim-agent").Return(types.ContainerJSON{}, errors.New("no such container")).Once()
+	assert.ErrorContains(t, a.discoverHostPaths(context.Background()), "set container-id")
+}
+
+// TestComposeMounts checks that compose.yaml mounts everything the worker needs.
+func TestComposeMounts(t *testing.T) {
+	data, err := os.ReadFile("compose.yaml")
+	assert.NoError(t, err)
+	var compose struct {
+		Services map[string]struct {
+			Environment map[string]string `yaml:"environment"`
+			Volumes     []string          `yaml:"volumes"`
+		} `yaml:"services"`
+	}
+	assert.NoError(t, yaml.Unmarshal(data, &compose))
+	service, ok := compose.Services["agent"]
+	assert.True(t, ok)
+
+	var mounts []types.MountPoint
+	for _, volume := range service.Volumes {
+		parts := strings.Split(os.ExpandEnv(volume), ":")
+		mounts = append(mounts, types.MountPoint{Type: mount.TypeBind, Source: parts[0], Destination: parts[1]})
+	}
+	translator := NewHostPathTranslator(mounts)
+	for _, path := range []string{DockerSocketPath, TmpResim, ExperienceCacheDirDefault, "/root/.docker", "/root/.aws", service.Environment["RESIM_AGENT_CONFIG_DIR"]} {
+		_, err := translator.HostPath(path)
+		assert.NoError(t, err)
+	}
+}
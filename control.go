@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+const (
+	ControlSocketFilename = "agent.sock"
+	// The control socket is only accessible to the user running the agent
+	controlSocketMode  = 0o600
+	pausePollInterval  = time.Second
+	controlHTTPTimeout = 30 * time.Second
+)
+
+type ControlStatus struct {
+	Version         string      `json:"version"`
+	Name            string      `json:"name"`
+	WorkerState     WorkerState `json:"workerState"`
+	WorkerID        string      `json:"workerID,omitempty"`
+	WorkerImage     string      `json:"workerImage,omitempty"`
+	WorkerStartedAt *time.Time  `json:"workerStartedAt,omitempty"`
+	// LastWorkerOutcome is how the last worker run ended, e.g. oom-killed
+	LastWorkerOutcome  WorkerOutcome `json:"lastWorkerOutcome,omitempty"`
+	LastWorkerExitCode int           `json:"lastWorkerExitCode,omitempty"`
+	ErrorCount         int           `json:"errorCount"`
+	MaxErrorCount      int           `json:"maxErrorCount"`
+	APIStatus          APIStatus     `json:"apiStatus,omitempty"`
+	Paused             bool          `json:"paused"`
+	// RigUnhealthy is why the rig was marked unhealthy, if it was
+	RigUnhealthy string `json:"rigUnhealthy,omitempty"`
+	// Probes are the results of the health probes, if any are configured
+	Probes []HealthCheck `json:"probes,omitempty"`
+	// PoolLabels are the configured and dynamic pool labels the agent advertises when its probes pass
+	PoolLabels  []string   `json:"poolLabels,omitempty"`
+	Draining    bool       `json:"draining"`
+	LastCheckin *time.Time `json:"lastCheckin,omitempty"`
+}
+
+type controlResponse struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (a *Agent) CurrentStatus() ControlStatus {
+	state := a.getState()
+	status := ControlStatus{
+		Version:            agentVersion,
+		Name:               a.Name,
+		WorkerState:        state.workerState,
+		WorkerID:           state.workerID,
+		WorkerImage:        state.workerImage,
+		LastWorkerOutcome:  state.lastWorkerOutcome,
+		LastWorkerExitCode: state.lastWorkerExitCode,
+		ErrorCount:         state.errorCount,
+		MaxErrorCount:      a.MaxErrorCount,
+		APIStatus:          state.apiStatus,
+		Paused:             state.paused,
+		RigUnhealthy:       state.rigUnhealthy,
+		Probes:             state.probes,
+		PoolLabels:         a.poolLabels(),
+		Draining:           state.draining,
+	}
+	if !state.workerStartedAt.IsZero() {
+		status.WorkerStartedAt = Ptr(state.workerStartedAt)
+	}
+	if !state.lastCheckin.IsZero() {
+		status.LastCheckin = Ptr(state.lastCheckin)
+	}
+	return status
+}
+
+// Pause stops the agent from launching new workers; a running worker is unaffected.
+func (a *Agent) Pause() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.paused = true
+	slog.Info("agent paused")
+}
+
+// Resume lets a paused agent, or one whose rig was marked unhealthy, take work
+// again.
+func (a *Agent) Resume() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.paused = false
+	a.state.rigUnhealthy = ""
+	slog.Info("agent resumed")
+}
+
+// Drain lets any running worker finish, then stops the agent.
+func (a *Agent) Drain() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.draining = true
+	slog.Info("agent draining")
+}
+
+func (a *Agent) isDraining() bool {
+	return a.getState().draining
+}
+
+func (a *Agent) isWorkerCancelled() bool {
+	return a.getState().workerCancelled
+}
+
+// CancelWorker stops the running worker container, if there is one.
+func (a *Agent) CancelWorker(ctx context.Context) error {
+	a.stateMutex.Lock()
+	containerID := a.state.workerContainerID
+	if containerID != "" {
+		a.state.workerCancelled = true
+	}
+	a.stateMutex.Unlock()
+
+	if containerID == "" {
+		return errors.New("no worker is running")
+	}
+	slog.Info("cancelling worker", "worker", a.getState().workerID)
+	return a.Docker.ContainerStop(ctx, containerID, container.StopOptions{})
+}
+
+// waitWhilePaused blocks the agent loop until the agent is resumed or drained.
+// An agent whose rig is unhealthy waits in the same way.
+func (a *Agent) waitWhilePaused() {
+	logged := false
+	for {
+		a.recordProgress()
+		state := a.getState()
+		if (!state.paused && state.rigUnhealthy == "") || state.draining {
+			return
+		}
+		if !logged && state.rigUnhealthy != "" {
+			slog.Info("rig is unhealthy, not taking work", "reason", state.rigUnhealthy)
+			logged = true
+		} else if !logged {
+			slog.Info("agent is paused, not taking work")
+			logged = true
+		}
+		time.Sleep(pausePollInterval)
+	}
+}
+
+func (a *Agent) getControlSocketPath() (string, error) {
+	if a.ControlSocket != "" {
+		return a.ControlSocket, nil
+	}
+	configDir, err := a.GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, ControlSocketFilename), nil
+}
+
+func (a *Agent) newControlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeControlJSON(w, http.StatusOK, a.CurrentStatus())
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, r *http.Request) {
+		a.Pause()
+		writeControlJSON(w, http.StatusOK, controlResponse{Message: "agent paused"})
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, r *http.Request) {
+		a.Resume()
+		writeControlJSON(w, http.StatusOK, controlResponse{Message: "agent resumed"})
+	})
+	mux.HandleFunc("POST /drain", func(w http.ResponseWriter, r *http.Request) {
+		a.Drain()
+		writeControlJSON(w, http.StatusOK, controlResponse{Message: "agent draining; it will exit once any running worker finishes"})
+	})
+	mux.HandleFunc("POST /cancel", func(w http.ResponseWriter, r *http.Request) {
+		err := a.CancelWorker(r.Context())
+		if err != nil {
+			writeControlJSON(w, http.StatusConflict, controlResponse{Error: err.Error()})
+			return
+		}
+		writeControlJSON(w, http.StatusOK, controlResponse{Message: "worker cancelled"})
+	})
+	return mux
+}
+
+func writeControlJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+// startControlServer serves the control API on a Unix socket, which is
+// protected by its file permissions.
+func (a *Agent) startControlServer() error {
+	if !a.ControlAPI {
+		return nil
+	}
+	socketPath, err := a.getControlSocketPath()
+	if err != nil {
+		return err
+	}
+
+	// Remove any socket left behind by a previous agent
+	err = os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(socketPath, controlSocketMode)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	server := &http.Server{
+		Handler:           a.newControlHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("control API server stopped", "err", err)
+		}
+	}()
+	slog.Info("control API listening", "socket", socketPath)
+
+	return nil
+}
+
+// newControlClient returns an HTTP client that talks to the control API on the given socket.
+func newControlClient(socketPath string) *http.Client {
+	return &http.Client{
+		Timeout: controlHTTPTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+}
+
+// runCtl implements the ctl subcommand, sending a command to a running agent
+// over its control socket and printing the response.
+func (a *Agent) runCtl(command string, out io.Writer) error {
+	var method string
+	switch command {
+	case "status":
+		method = http.MethodGet
+	case "pause", "resume", "drain", "cancel":
+		method = http.MethodPost
+	default:
+		return fmt.Errorf("unknown ctl command %q: must be one of status, pause, resume, drain or cancel", command)
+	}
+
+	socketPath, err := a.getControlSocketPath()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, "http://agent/"+command, nil)
+	if err != nil {
+		return err
+	}
+	res, err := newControlClient(socketPath).Do(req)
+	if err != nil {
+		return fmt.Errorf("error connecting to agent at %v: %w", socketPath, err)
+	}
+	defer res.Body.Close()
+
+	if command == "status" {
+		var status ControlStatus
+		err = json.NewDecoder(res.Body).Decode(&status)
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+
+	var response controlResponse
+	err = json.NewDecoder(res.Body).Decode(&response)
+	if err != nil {
+		return err
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	fmt.Fprintln(out, response.Message)
+	return nil
+}
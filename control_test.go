@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newControlTestAgent(t *testing.T) (*Agent, *MockDockerClient) {
+	mockDocker := &MockDockerClient{}
+	a := New(mockDocker)
+	a.Name = DefaultTestAgentName
+	a.MaxErrorCount = 3
+	a.ControlAPI = true
+	a.ControlSocket = filepath.Join(t.TempDir(), ControlSocketFilename)
+	assert.NoError(t, a.startControlServer())
+	return a, mockDocker
+}
+
+func TestControlStatus(t *testing.T) {
+	a, _ := newControlTestAgent(t)
+	a.currentWorkerID = "worker-id"
+	a.setWorkerImage("public.ecr.aws/resim/experience-worker:latest")
+	a.workerStarted("container-id")
+	a.recordErrorCount(2)
+
+	var out bytes.Buffer
+	err := a.runCtl("status", &out)
+	assert.NoError(t, err)
+
+	var status ControlStatus
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &status))
+	assert.Equal(t, agentVersion, status.Version)
+	assert.Equal(t, DefaultTestAgentName, status.Name)
+	assert.Equal(t, WorkerStateRunning, status.WorkerState)
+	assert.Equal(t, "worker-id", status.WorkerID)
+	assert.Equal(t, "public.ecr.aws/resim/experience-worker:latest", status.WorkerImage)
+	assert.NotNil(t, status.WorkerStartedAt)
+	assert.Equal(t, 2, status.ErrorCount)
+	assert.Equal(t, 3, status.MaxErrorCount)
+}
+
+func TestControlPauseResumeDrain(t *testing.T) {
+	a, _ := newControlTestAgent(t)
+
+	var out bytes.Buffer
+	assert.NoError(t, a.runCtl("pause", &out))
+	assert.True(t, a.CurrentStatus().Paused)
+	assert.NoError(t, a.runCtl("resume", &out))
+	assert.False(t, a.CurrentStatus().Paused)
+
+	// A paused agent that is drained stops waiting
+	a.Pause()
+	assert.NoError(t, a.runCtl("drain", &out))
+	a.waitWhilePaused()
+	assert.True(t, a.isDraining())
+	assert.Contains(t, out.String(), "agent paused\nagent resumed\nagent draining")
+}
+
+func TestControlCancel(t *testing.T) {
+	a, mockDocker := newControlTestAgent(t)
+	defer mockDocker.AssertExpectations(t)
+
+	var out bytes.Buffer
+	err := a.runCtl("cancel", &out)
+	assert.ErrorContains(t, err, "no worker is running")
+
+	mockDocker.On("ContainerStop", mock.Anything, "container-id", container.StopOptions{}).Return(nil).Once()
+	a.workerStarted("container-id")
+	err = a.runCtl("cancel", &out)
+	assert.NoError(t, err)
+	assert.True(t, a.isWorkerCancelled())
+
+	a.setWorkerState(WorkerStateIdle)
+	assert.False(t, a.isWorkerCancelled())
+}
+
+func TestControlUnknownCommand(t *testing.T) {
+	a := New(nil)
+	err := a.runCtl("reboot", &bytes.Buffer{})
+	assert.ErrorContains(t, err, "unknown ctl command")
+}
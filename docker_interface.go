@@ -8,17 +8,32 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/api/types/system"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/stretchr/testify/mock"
 )
 
 type DockerClient interface {
 	ImagePull(ctx context.Context, refStr string, options image.PullOptions) (io.ReadCloser, error)
+	ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error)
+	ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error)
+	ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error)
+	DistributionInspect(ctx context.Context, imageRef, encodedRegistryAuth string) (registry.DistributionInspect, error)
 	Close() error
 	ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *ocispec.Platform, containerName string) (container.CreateResponse, error)
 	ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error
 	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
 	ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error
+	ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error
+	ContainerKill(ctx context.Context, containerID, signal string) error
+	NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error)
+	NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error)
+	Ping(ctx context.Context) (types.Ping, error)
+	ServerVersion(ctx context.Context) (types.Version, error)
+	Info(ctx context.Context) (system.Info, error)
+	DaemonHost() string
 }
 
 type MockDockerClient struct {
@@ -30,6 +45,26 @@ func (m *MockDockerClient) ImagePull(ctx context.Context, refStr string, options
 	return args.Get(0).(io.ReadCloser), args.Error(1)
 }
 
+func (m *MockDockerClient) ImageInspectWithRaw(ctx context.Context, imageID string) (types.ImageInspect, []byte, error) {
+	args := m.Called(ctx, imageID)
+	return args.Get(0).(types.ImageInspect), nil, args.Error(1)
+}
+
+func (m *MockDockerClient) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	args := m.Called(ctx, options)
+	return args.Get(0).([]image.Summary), args.Error(1)
+}
+
+func (m *MockDockerClient) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	args := m.Called(ctx, imageID, options)
+	return args.Get(0).([]image.DeleteResponse), args.Error(1)
+}
+
+func (m *MockDockerClient) DistributionInspect(ctx context.Context, imageRef, encodedRegistryAuth string) (registry.DistributionInspect, error) {
+	args := m.Called(ctx, imageRef, encodedRegistryAuth)
+	return args.Get(0).(registry.DistributionInspect), args.Error(1)
+}
+
 func (m *MockDockerClient) Close() error {
 	args := m.Called()
 	return args.Error(0)
@@ -40,11 +75,26 @@ func (m *MockDockerClient) ContainerCreate(ctx context.Context, config *containe
 	return args.Get(0).(container.CreateResponse), args.Error(1)
 }
 
+func (m *MockDockerClient) NetworkInspect(ctx context.Context, networkID string, options network.InspectOptions) (network.Inspect, error) {
+	args := m.Called(ctx, networkID, options)
+	return args.Get(0).(network.Inspect), args.Error(1)
+}
+
+func (m *MockDockerClient) NetworkCreate(ctx context.Context, name string, options network.CreateOptions) (network.CreateResponse, error) {
+	args := m.Called(ctx, name, options)
+	return args.Get(0).(network.CreateResponse), args.Error(1)
+}
+
 func (m *MockDockerClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
 	args := m.Called(ctx, containerID)
 	return args.Get(0).(types.ContainerJSON), args.Error(1)
 }
 
+func (m *MockDockerClient) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	args := m.Called(ctx, options)
+	return args.Get(0).([]types.Container), args.Error(1)
+}
+
 func (m *MockDockerClient) ContainerStart(ctx context.Context, containerID string, options container.StartOptions) error {
 	args := m.Called(ctx, containerID, options)
 	return args.Error(0)
@@ -54,3 +104,33 @@ func (m *MockDockerClient) ContainerRemove(ctx context.Context, containerID stri
 	args := m.Called(ctx, containerID, options)
 	return args.Error(0)
 }
+
+func (m *MockDockerClient) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	args := m.Called(ctx, containerID, options)
+	return args.Error(0)
+}
+
+func (m *MockDockerClient) ContainerKill(ctx context.Context, containerID, signal string) error {
+	args := m.Called(ctx, containerID, signal)
+	return args.Error(0)
+}
+
+func (m *MockDockerClient) Ping(ctx context.Context) (types.Ping, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(types.Ping), args.Error(1)
+}
+
+func (m *MockDockerClient) ServerVersion(ctx context.Context) (types.Version, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(types.Version), args.Error(1)
+}
+
+func (m *MockDockerClient) Info(ctx context.Context) (system.Info, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(system.Info), args.Error(1)
+}
+
+func (m *MockDockerClient) DaemonHost() string {
+	args := m.Called()
+	return args.String(0)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/resim-ai/agent/api"
+	"github.com/spf13/viper"
+	"golang.org/x/oauth2"
+)
+
+// maxClockSkew is the largest difference from the auth server's clock that
+// doctor accepts; beyond this, tokens may be rejected as expired or not yet valid.
+const maxClockSkew = 30 * time.Second
+
+const doctorCheckTimeout = 10 * time.Second
+
+type DoctorStatus string
+
+const (
+	DoctorStatusPass DoctorStatus = "PASS"
+	DoctorStatusWarn DoctorStatus = "WARN"
+	DoctorStatusFail DoctorStatus = "FAIL"
+	DoctorStatusSkip DoctorStatus = "SKIP"
+)
+
+// DoctorResult is the outcome of one of doctor's checks, with a hint on how to
+// fix it if it did not pass.
+type DoctorResult struct {
+	Name   string
+	Status DoctorStatus
+	Detail string
+	Hint   string
+}
+
+func doctorPass(name string, detail string) DoctorResult {
+	return DoctorResult{Name: name, Status: DoctorStatusPass, Detail: detail}
+}
+
+func doctorFail(name string, detail string, hint string) DoctorResult {
+	return DoctorResult{Name: name, Status: DoctorStatusFail, Detail: detail, Hint: hint}
+}
+
+func doctorSkip(name string, reason string) DoctorResult {
+	return DoctorResult{Name: name, Status: DoctorStatusSkip, Detail: reason}
+}
+
+// Doctor checks that the agent's environment is set up correctly to run workers:
+// its config, Docker, the agent's directories, credentials, the system clock and
+// connectivity to ReSim. configErr is the error loading the agent's config, if
+// any. Later checks are skipped if those they depend on fail.
+func (a *Agent) Doctor(ctx context.Context, configErr error) []DoctorResult {
+	var results []DoctorResult
+
+	socketResult := a.checkDockerSocket()
+	results = append(results, socketResult)
+	dockerResult := a.checkDockerVersion(ctx)
+	results = append(results, dockerResult)
+
+	configDir, err := a.GetConfigDir()
+	if err != nil {
+		results = append(results, doctorFail("config-dir", err.Error(), "set --config-dir or RESIM_AGENT_CONFIG_DIR to a directory the agent's user can create"))
+	} else {
+		results = append(results, checkWritable("config-dir", configDir), checkConfig(configDir, configErr))
+	}
+	if slices.Contains(a.LogDestinations, LogDestinationFile) {
+		results = append(results, checkWritable("log-dir", a.getLogDir()))
+	}
+
+	results = append(results,
+		a.checkDiskSpace("worker-dir-disk", a.WorkerDir),
+		a.checkDiskSpace("experience-cache-disk", a.ExperienceCacheDir),
+		a.checkAWSConfig(),
+	)
+
+	authResult, token := a.checkAuth()
+	results = append(results, authResult, a.checkClockSkew(ctx))
+
+	if authResult.Status != DoctorStatusPass {
+		results = append(results,
+			doctorSkip("api", "authentication failed"),
+			doctorSkip("worker-image", "authentication failed"),
+		)
+		return results
+	}
+	apiClient, err := api.NewClientWithResponses(
+		a.APIHost,
+		api.WithHTTPClient(oauth2.NewClient(context.WithValue(ctx, oauth2.HTTPClient, a.HTTPClient), oauth2.StaticTokenSource(token))),
+		api.WithRequestEditorFn(AddAgentIDEditor(a.Name, agentVersion)),
+		api.WithRequestEditorFn(AddAgentPlatformEditor(a.Platform)),
+	)
+	if err != nil {
+		results = append(results, doctorFail("api", err.Error(), fmt.Sprintf("check api-host (%v)", a.APIHost)))
+		return results
+	}
+	a.APIClient = apiClient
+	apiResult := a.checkAPI(ctx)
+	results = append(results, apiResult)
+
+	switch {
+	case dockerResult.Status != DoctorStatusPass:
+		results = append(results, doctorSkip("worker-image", "Docker is not available"))
+	case apiResult.Status != DoctorStatusPass:
+		results = append(results, doctorSkip("worker-image", "the Agent API is not available"))
+	default:
+		results = append(results, a.checkWorkerImagePull(ctx))
+	}
+	return results
+}
+
+// checkConfig checks that the agent's config file exists and loaded. Without it,
+// the other checks use the defaults and environment.
+func checkConfig(configDir string, configErr error) DoctorResult {
+	const name = "config"
+	configPath := filepath.Join(configDir, ConfigFilename)
+	if configErr != nil {
+		return doctorFail(name, configErr.Error(), fmt.Sprintf("fix %v or its drop-in files; resim-agent validate-config checks them", configPath))
+	}
+	_, err := os.Stat(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return doctorFail(name, fmt.Sprintf("%v does not exist, using the defaults", configPath), "create it, setting at least name and pool-labels")
+	}
+	if err != nil {
+		return doctorFail(name, err.Error(), fmt.Sprintf("check the permissions of %v", configPath))
+	}
+	return doctorPass(name, fmt.Sprintf("loaded %v", configPath))
+}
+
+func (a *Agent) checkDockerSocket() DoctorResult {
+	const name = "docker-socket"
+	host := a.Docker.DaemonHost()
+	socketPath, isUnix := strings.CutPrefix(host, "unix://")
+	if !isUnix {
+		return doctorPass(name, fmt.Sprintf("using %v", host))
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, doctorCheckTimeout)
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return doctorFail(name, fmt.Sprintf("permission denied connecting to %v", socketPath),
+			"add the user running the agent to the docker group (sudo usermod -aG docker <user>) and log in again")
+	case errors.Is(err, os.ErrNotExist):
+		return doctorFail(name, fmt.Sprintf("%v does not exist", socketPath),
+			"check that Docker is installed and running, or set DOCKER_HOST to the location of its socket")
+	case err != nil:
+		return doctorFail(name, err.Error(), "check that the Docker daemon is running (systemctl status docker)")
+	}
+	conn.Close()
+	return doctorPass(name, fmt.Sprintf("connected to %v", socketPath))
+}
+
+func (a *Agent) checkDockerVersion(ctx context.Context) DoctorResult {
+	const name = "docker"
+	ctx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+	defer cancel()
+	version, err := a.Docker.ServerVersion(ctx)
+	if err != nil {
+		return doctorFail(name, err.Error(), "check that the Docker daemon is running (systemctl status docker)")
+	}
+	a.detectPlatform(version)
+	runtime := "Docker"
+	if containerRuntimeFromVersion(version) == ContainerRuntimePodman {
+		runtime = "Podman"
+	}
+	return doctorPass(name, fmt.Sprintf("%v %v (API %v) on %v/%v", runtime, version.Version, version.APIVersion, version.Os, version.Arch))
+}
+
+// checkWritable checks that dir exists, or can be created, and that the agent can
+// create files in it.
+func checkWritable(name string, dir string) DoctorResult {
+	hint := fmt.Sprintf("make %v writable by the user running the agent, or choose another directory", dir)
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return doctorFail(name, err.Error(), hint)
+	}
+	f, err := os.CreateTemp(dir, ".doctor-*")
+	if err != nil {
+		return doctorFail(name, err.Error(), hint)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return doctorPass(name, fmt.Sprintf("%v is writable", dir))
+}
+
+// checkDiskSpace checks the free space for dir, which is created by the agent
+// when it starts so may not exist yet; if so, its nearest existing parent is checked.
+func (a *Agent) checkDiskSpace(name string, dir string) DoctorResult {
+	existingDir := dir
+	for {
+		if _, err := os.Stat(existingDir); err == nil || filepath.Dir(existingDir) == existingDir {
+			break
+		}
+		existingDir = filepath.Dir(existingDir)
+	}
+	check := a.diskHealth(name, existingDir)
+	if !check.OK {
+		return doctorFail(name, check.Detail, fmt.Sprintf("free up space on the disk holding %v, so that at least %v MB is available", dir, a.HealthMinFreeDiskMB))
+	}
+	return doctorPass(name, check.Detail)
+}
+
+func (a *Agent) checkAWSConfig() DoctorResult {
+	const name = "aws-config"
+	if !a.HostAWSConfigExists {
+		return DoctorResult{
+			Name:   name,
+			Status: DoctorStatusWarn,
+			Detail: "no AWS config directory found, so none will be mounted for the worker",
+			Hint:   "if your jobs use AWS, run aws configure as the user running the agent, or set aws-config-source-dir",
+		}
+	}
+	return doctorPass(name, fmt.Sprintf("found %v", a.HostAWSConfigDir))
+}
+
+// checkAuth logs in with the configured credentials, returning the token so that
+// the API checks can use it.
+func (a *Agent) checkAuth() (DoctorResult, *oauth2.Token) {
+	const name = "auth"
+	token, err := a.requestToken(authModePassword)
+	if err != nil {
+		return doctorFail(name, err.Error(), fmt.Sprintf("check that auth-host (%v) is correct and reachable from this host", a.AuthHost)), nil
+	}
+	if !token.Valid() {
+		return doctorFail(name, fmt.Sprintf("could not log in to %v as %v", a.AuthHost, viper.GetString(UsernameKey)),
+			"check the username and password provided by ReSim, and that auth-host matches api-host's environment"), nil
+	}
+	return doctorPass(name, fmt.Sprintf("logged in to %v as %v", a.AuthHost, viper.GetString(UsernameKey))), token
+}
+
+// checkClockSkew compares the local clock with the Date header of a response
+// from the auth server.
+func (a *Agent) checkClockSkew(ctx context.Context) DoctorResult {
+	const name = "clock-skew"
+	ctx, cancel := context.WithTimeout(ctx, doctorCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, a.AuthHost, nil)
+	if err != nil {
+		return doctorFail(name, err.Error(), fmt.Sprintf("check auth-host (%v)", a.AuthHost))
+	}
+	requestStart := time.Now()
+	res, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return doctorSkip(name, fmt.Sprintf("could not reach %v: %v", a.AuthHost, err))
+	}
+	res.Body.Close()
+	serverTime, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return doctorSkip(name, fmt.Sprintf("%v did not return a valid Date header", a.AuthHost))
+	}
+
+	// The Date header has a resolution of a second, so compare it with the midpoint of the request
+	localTime := requestStart.Add(time.Since(requestStart) / 2)
+	skew := localTime.Sub(serverTime).Round(time.Second)
+	if skew.Abs() > maxClockSkew {
+		return doctorFail(name, fmt.Sprintf("local clock differs from %v by %v", a.AuthHost, skew),
+			"synchronise the system clock, e.g. by enabling NTP with timedatectl set-ntp true")
+	}
+	return doctorPass(name, fmt.Sprintf("local clock is within %v of %v", maxClockSkew, a.AuthHost))
+}
+
+func (a *Agent) checkAPI(ctx context.Context) DoctorResult {
+	const name = "api"
+	status, detail := a.probeAPI(ctx)
+	switch status {
+	case APIStatusOK:
+		return doctorPass(name, fmt.Sprintf("%v is reachable", a.APIHost))
+	case APIStatusUnavailable:
+		return doctorFail(name, detail, "the Agent API may be down for maintenance; try again later, or contact ReSim support")
+	case APIStatusUnauthorized:
+		return doctorFail(name, detail, "check that auth-host is for the same environment as api-host, and that the agent's credentials are enabled")
+	case APIStatusBadRequest:
+		return doctorFail(name, detail, "update the agent with resim-agent update")
+	default:
+		return doctorFail(name, detail, fmt.Sprintf("check that api-host (%v) is correct and reachable from this host", a.APIHost))
+	}
+}
+
+// checkWorkerImagePull checks in to find the worker image, and pulls it.
+func (a *Agent) checkWorkerImagePull(ctx context.Context) DoctorResult {
+	const name = "worker-image"
+	checkin, err := a.checkin(ctx)
+	if err != nil {
+		return doctorFail(name, fmt.Sprintf("error checking in: %v", err), "check that the agent's name and pool labels are valid")
+	}
+	if checkin.WorkerImageURI == nil {
+		return doctorFail(name, "no worker image received on checkin", "contact ReSim support")
+	}
+
+	platform := formatPlatform(a.Platform)
+	if a.ImagePullPolicy != ImagePullPolicyAlways {
+		local, found, err := a.localImage(ctx, *checkin.WorkerImageURI)
+		switch {
+		case err != nil:
+			return doctorFail(name, err.Error(), "check that the container runtime is running")
+		case found:
+			return doctorPass(name, fmt.Sprintf("%v is present locally for %v", local.Ref(), platform))
+		case a.ImagePullPolicy == ImagePullPolicyNever:
+			return doctorFail(name, a.missingImageError(ctx, *checkin.WorkerImageURI).Error(),
+				"load the worker image, e.g. with docker load, or set image-pull-policy to if-not-present")
+		}
+	}
+	_, err = a.pullImage(ctx, *checkin.WorkerImageURI)
+	var platformErr *ImagePlatformError
+	switch {
+	case errors.As(err, &platformErr):
+		return doctorFail(name, err.Error(), "set platform to one this host can run that the worker image is available for, or contact ReSim support")
+	case err != nil:
+		return doctorFail(name, fmt.Sprintf("error pulling %v: %v", *checkin.WorkerImageURI, err),
+			"check that this host can reach the registry, and any proxy, registry-credentials or ~/.docker/config.json settings")
+	}
+	return doctorPass(name, fmt.Sprintf("pulled %v for %v", *checkin.WorkerImageURI, platform))
+}
+
+// writeDoctorResults prints the results, with hints for those that did not pass,
+// and returns the number of failed checks.
+func writeDoctorResults(w io.Writer, results []DoctorResult) int {
+	failed := 0
+	for _, result := range results {
+		fmt.Fprintf(w, "[%v] %v: %v\n", result.Status, result.Name, result.Detail)
+		if result.Hint != "" {
+			fmt.Fprintf(w, "       hint: %v\n", result.Hint)
+		}
+		if result.Status == DoctorStatusFail {
+			failed++
+		}
+	}
+	return failed
+}
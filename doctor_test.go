@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newDoctorTestServer serves the auth server and Agent API endpoints used by doctor.
+func newDoctorTestServer(t *testing.T, serverTime time.Time, accessToken string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", serverTime.UTC().Format(http.TimeFormat))
+		switch r.URL.Path {
+		case "/oauth/token":
+			w.Write([]byte(`{"access_token": "` + accessToken + `", "token_type": "Bearer", "expires_in": 3600}`))
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/agentapiping":
+			if r.Header.Get("Authorization") != "Bearer "+accessToken {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		case "/agent/checkin":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"workerImageURI": "public.ecr.aws/resim/agent-worker:latest"}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newDoctorTestAgent(t *testing.T, server *httptest.Server) (*Agent, *MockDockerClient) {
+	a, mockDocker := newHealthTestAgent(t)
+	a.ConfigDirOverride = t.TempDir()
+	a.LogDirOverride = filepath.Join(t.TempDir(), "logs")
+	a.LogDestinations = []LogDestination{LogDestinationFile}
+	a.HostAWSConfigExists = true
+	a.AuthHost = server.URL
+	a.APIHost = server.URL
+	return a, mockDocker
+}
+
+func doctorResultsByName(results []DoctorResult) map[string]DoctorResult {
+	byName := map[string]DoctorResult{}
+	for _, result := range results {
+		byName[result.Name] = result
+	}
+	return byName
+}
+
+func TestDoctor(t *testing.T) {
+	server := newDoctorTestServer(t, time.Now(), "access-token")
+	a, mockDocker := newDoctorTestAgent(t, server)
+	mockDocker.On("DaemonHost").Return("tcp://docker:2375")
+	mockDocker.On("ServerVersion", mock.Anything).Return(types.Version{Version: "27.5.0", APIVersion: "1.47", Os: "linux", Arch: "amd64"}, nil)
+	mockDocker.On("ImagePull", mock.Anything, "public.ecr.aws/resim/agent-worker:latest", mock.Anything).Return(io.NopCloser(strings.NewReader("{}")), nil)
+	defer mockDocker.AssertExpectations(t)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(a.ConfigDirOverride, ConfigFilename), []byte("name: test-agent\n"), 0600))
+
+	results := a.Doctor(t.Context(), nil)
+	for _, result := range results {
+		assert.Equal(t, DoctorStatusPass, result.Status, "%v: %v", result.Name, result.Detail)
+	}
+	byName := doctorResultsByName(results)
+	assert.Contains(t, byName["docker"].Detail, "Docker 27.5.0")
+	assert.Contains(t, byName["worker-image"].Detail, "public.ecr.aws/resim/agent-worker:latest")
+	assert.Contains(t, byName, "log-dir")
+
+	var out bytes.Buffer
+	assert.Equal(t, 0, writeDoctorResults(&out, results))
+	assert.Contains(t, out.String(), "[PASS] auth: logged in to "+server.URL)
+}
+
+func TestDoctorFailures(t *testing.T) {
+	server := newDoctorTestServer(t, time.Now().Add(-time.Hour), "")
+	a, mockDocker := newDoctorTestAgent(t, server)
+	a.HostAWSConfigExists = false
+	mockDocker.On("DaemonHost").Return("unix://" + filepath.Join(t.TempDir(), "docker.sock"))
+	mockDocker.On("ServerVersion", mock.Anything).Return(types.Version{}, errors.New("Cannot connect to the Docker daemon"))
+	defer mockDocker.AssertExpectations(t)
+
+	results := a.Doctor(t.Context(), nil)
+	byName := doctorResultsByName(results)
+	assert.Equal(t, DoctorStatusFail, byName["config"].Status)
+	assert.Contains(t, byName["config"].Detail, "does not exist, using the defaults")
+	assert.Equal(t, DoctorStatusFail, byName["docker-socket"].Status)
+	assert.Contains(t, byName["docker-socket"].Hint, "DOCKER_HOST")
+	assert.Equal(t, DoctorStatusFail, byName["docker"].Status)
+	assert.Equal(t, DoctorStatusWarn, byName["aws-config"].Status)
+	assert.Equal(t, DoctorStatusFail, byName["auth"].Status)
+	assert.Contains(t, byName["auth"].Hint, "username and password")
+	assert.Equal(t, DoctorStatusFail, byName["clock-skew"].Status)
+	assert.Contains(t, byName["clock-skew"].Hint, "NTP")
+	assert.Equal(t, DoctorStatusSkip, byName["api"].Status)
+	assert.Equal(t, DoctorStatusSkip, byName["worker-image"].Status)
+
+	var out bytes.Buffer
+	assert.Equal(t, 5, writeDoctorResults(&out, results))
+	assert.Contains(t, out.String(), "hint: ")
+}
+
+func TestDoctorConfigError(t *testing.T) {
+	result := checkConfig(t.TempDir(), errors.New("error loading config: invalid log format"))
+	assert.Equal(t, DoctorStatusFail, result.Status)
+	assert.Equal(t, "error loading config: invalid log format", result.Detail)
+	assert.Contains(t, result.Hint, "validate-config")
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+type WorkerState string
+
+const (
+	WorkerStateIdle    WorkerState = "idle"
+	WorkerStatePulling WorkerState = "pulling"
+	WorkerStateRunning WorkerState = "running"
+)
+
+type HealthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type HealthReport struct {
+	OK          bool          `json:"ok"`
+	Version     string        `json:"version"`
+	WorkerState WorkerState   `json:"workerState"`
+	APIStatus   APIStatus     `json:"apiStatus,omitempty"`
+	LastCheckin *time.Time    `json:"lastCheckin,omitempty"`
+	Checks      []HealthCheck `json:"checks"`
+}
+
+// agentState is the part of the agent's state that is read from outside the
+// agent loop, e.g. by the HTTP server; access it via the Agent's stateMutex.
+type agentState struct {
+	startedAt         time.Time
+	workerState       WorkerState
+	workerID          string
+	workerImage       string
+	workerContainerID string
+	workerStartedAt   time.Time
+	workerCancelled   bool
+	// How the last worker run ended
+	lastWorkerOutcome  WorkerOutcome
+	lastWorkerExitCode int
+	lastCheckin        time.Time
+	// When the agent loop last made progress, e.g. started an iteration or checked on its worker
+	lastProgress  time.Time
+	authenticated bool
+	errorCount    int
+	apiStatus     APIStatus
+	paused        bool
+	// Why the rig is unhealthy, e.g. a pre-task hook failed; the agent takes no work until resumed
+	rigUnhealthy string
+	// The results of the health probes when they were last evaluated
+	probes            []HealthCheck
+	probesEvaluatedAt time.Time
+	// The dynamic pool labels when they were last evaluated
+	dynamicPoolLabels []string
+	draining          bool
+}
+
+func (a *Agent) setWorkerState(state WorkerState) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.workerState = state
+	if state == WorkerStateIdle {
+		a.state.workerID = ""
+		a.state.workerImage = ""
+		a.state.workerContainerID = ""
+		a.state.workerStartedAt = time.Time{}
+		a.state.workerCancelled = false
+	}
+}
+
+func (a *Agent) workerStarted(containerID string) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.workerState = WorkerStateRunning
+	a.state.workerID = a.currentWorkerID
+	a.state.workerContainerID = containerID
+	a.state.workerStartedAt = time.Now()
+}
+
+func (a *Agent) setWorkerImage(imageURI string) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.workerImage = imageURI
+}
+
+func (a *Agent) recordStart() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.startedAt = time.Now()
+}
+
+func (a *Agent) recordCheckin() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.lastCheckin = time.Now()
+}
+
+func (a *Agent) recordProgress() {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.lastProgress = time.Now()
+}
+
+func (a *Agent) recordAuth(authenticated bool) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.authenticated = authenticated
+}
+
+func (a *Agent) recordAPIStatus(status APIStatus) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.apiStatus = status
+}
+
+func (a *Agent) recordErrorCount(count int) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.errorCount = count
+}
+
+func (a *Agent) getState() agentState {
+	a.stateMutex.RLock()
+	defer a.stateMutex.RUnlock()
+	state := a.state
+	if state.workerState == "" {
+		state.workerState = WorkerStateIdle
+	}
+	return state
+}
+
+// checkinHealth fails if the agent has not checked in successfully recently. The
+// heartbeat checks in every minute, including while a worker is running.
+func (a *Agent) checkinHealth(state agentState) HealthCheck {
+	check := HealthCheck{Name: "checkin"}
+	if state.lastCheckin.IsZero() {
+		check.Detail = "no successful checkin yet"
+		return check
+	}
+	since := time.Since(state.lastCheckin)
+	check.OK = since <= a.HealthCheckinTimeout
+	check.Detail = fmt.Sprintf("last successful checkin %v ago", since.Round(time.Second))
+	return check
+}
+
+// progressHealth fails if the agent loop has not made progress recently, e.g.
+// because it is deadlocked or stuck on a hung call. Before the loop first makes
+// progress, the time since the agent started is used.
+func (a *Agent) progressHealth(state agentState) HealthCheck {
+	check := HealthCheck{Name: "progress"}
+	lastProgress := state.lastProgress
+	if lastProgress.IsZero() {
+		lastProgress = state.startedAt
+	}
+	since := time.Since(lastProgress)
+	check.OK = since <= a.HealthProgressTimeout
+	check.Detail = fmt.Sprintf("last progress %v ago", since.Round(time.Second))
+	return check
+}
+
+func (a *Agent) dockerHealth(ctx context.Context) HealthCheck {
+	check := HealthCheck{Name: "docker"}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	ping, err := a.Docker.Ping(ctx)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	check.OK = true
+	check.Detail = fmt.Sprintf("API version %v", ping.APIVersion)
+	return check
+}
+
+func (a *Agent) diskHealth(name string, dir string) HealthCheck {
+	check := HealthCheck{Name: name}
+	free, err := freeDiskBytes(dir)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	freeMB := free / (1024 * 1024)
+	check.OK = freeMB >= a.HealthMinFreeDiskMB
+	check.Detail = fmt.Sprintf("%v MB free in %v", freeMB, dir)
+	return check
+}
+
+// rigHealth fails if the rig has been marked unhealthy, e.g. by a failed pre-task
+// hook.
+func rigHealth(state agentState) HealthCheck {
+	if state.rigUnhealthy != "" {
+		return HealthCheck{Name: "rig", Detail: state.rigUnhealthy}
+	}
+	return HealthCheck{Name: "rig", OK: true}
+}
+
+func freeDiskBytes(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// Liveness reports whether the agent loop is making progress; it is used by
+// /healthz and to gate the systemd watchdog. It doesn't depend on the Agent API,
+// so that an API outage doesn't get the agent restarted.
+func (a *Agent) Liveness() HealthReport {
+	state := a.getState()
+	report := a.newHealthReport(state)
+	report.Checks = []HealthCheck{a.progressHealth(state)}
+	report.OK = allHealthy(report.Checks)
+	return report
+}
+
+// Readiness reports whether the agent is able to take on work.
+func (a *Agent) Readiness(ctx context.Context) HealthReport {
+	state := a.getState()
+	report := a.newHealthReport(state)
+	report.Checks = []HealthCheck{
+		{Name: "auth", OK: state.authenticated},
+		a.checkinHealth(state),
+		a.dockerHealth(ctx),
+		a.diskHealth("worker-dir-disk", a.WorkerDir),
+		a.diskHealth("experience-cache-disk", a.ExperienceCacheDir),
+		rigHealth(state),
+	}
+	if len(a.HealthProbes) > 0 {
+		report.Checks = append(report.Checks, probesHealth(state))
+	}
+	report.OK = allHealthy(report.Checks)
+	return report
+}
+
+func (a *Agent) newHealthReport(state agentState) HealthReport {
+	report := HealthReport{
+		Version:     agentVersion,
+		WorkerState: state.workerState,
+		APIStatus:   state.apiStatus,
+	}
+	if !state.lastCheckin.IsZero() {
+		report.LastCheckin = Ptr(state.lastCheckin)
+	}
+	return report
+}
+
+func allHealthy(checks []HealthCheck) bool {
+	for _, check := range checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func (a *Agent) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, a.Liveness())
+}
+
+func (a *Agent) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, a.Readiness(r.Context()))
+}
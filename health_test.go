@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newHealthTestAgent(t *testing.T) (*Agent, *MockDockerClient) {
+	mockDocker := &MockDockerClient{}
+	a := New(mockDocker)
+	a.WorkerDir = t.TempDir()
+	a.ExperienceCacheDir = t.TempDir()
+	a.HealthMinFreeDiskMB = 0
+	return a, mockDocker
+}
+
+func TestLiveness(t *testing.T) {
+	a, _ := newHealthTestAgent(t)
+
+	// Healthy during startup, before the loop first makes progress
+	a.recordStart()
+	assert.True(t, a.Liveness().OK)
+
+	// Unhealthy if the loop makes no progress
+	a.HealthProgressTimeout = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	assert.False(t, a.Liveness().OK)
+
+	a.HealthProgressTimeout = time.Minute
+	a.recordProgress()
+	report := a.Liveness()
+	assert.True(t, report.OK)
+	assert.Nil(t, report.LastCheckin)
+	assert.Equal(t, WorkerStateIdle, report.WorkerState)
+
+	// Failing checkins, e.g. during an Agent API outage, make the agent not ready
+	// but not unhealthy, so that it isn't restarted
+	a.HealthCheckinTimeout = time.Millisecond
+	a.recordCheckin()
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, a.Liveness().OK)
+	assert.False(t, a.checkinHealth(a.getState()).OK)
+}
+
+func TestReadiness(t *testing.T) {
+	a, mockDocker := newHealthTestAgent(t)
+	mockDocker.On("Ping", mock.Anything).Return(types.Ping{APIVersion: "1.47"}, nil).Once()
+	mockDocker.On("Ping", mock.Anything).Return(types.Ping{}, errors.New("cannot connect to the Docker daemon")).Once()
+	defer mockDocker.AssertExpectations(t)
+
+	a.recordStart()
+	a.recordAuth(true)
+	a.recordCheckin()
+	a.currentWorkerID = "worker-id"
+	a.workerStarted("container-id")
+
+	recorder := httptest.NewRecorder()
+	a.newHTTPHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var report HealthReport
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &report))
+	assert.True(t, report.OK)
+	assert.Equal(t, WorkerStateRunning, report.WorkerState)
+	assert.Len(t, report.Checks, 6)
+
+	recorder = httptest.NewRecorder()
+	a.newHTTPHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "cannot connect to the Docker daemon")
+}
+
+func TestReadinessInsufficientDisk(t *testing.T) {
+	a, _ := newHealthTestAgent(t)
+	a.HealthMinFreeDiskMB = 1 << 40
+
+	check := a.diskHealth("worker-dir-disk", a.WorkerDir)
+	assert.False(t, check.OK)
+	assert.Contains(t, check.Detail, "MB free in "+a.WorkerDir)
+}
+
+func TestSdNotify(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	assert.NoError(t, sdNotify("READY=1"))
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "READY=1", string(buffer[:n]))
+}
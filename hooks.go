@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Kinds of task hook, passed to hooks as RESIM_HOOK
+const (
+	hookPreTask  = "pre-task"
+	hookPostTask = "post-task"
+)
+
+// hookWaitDelay is how long a hook's output is waited for after it is killed for
+// timing out, in case it started processes that hold it open.
+const hookWaitDelay = 5 * time.Second
+
+// TaskHook is a command run by the agent before or after each worker, e.g. to
+// power-cycle a rig's hardware or collect its logs.
+type TaskHook struct {
+	// Name identifies the hook in logs; the command's path is used if empty
+	Name    string   `mapstructure:"name"`
+	Command []string `mapstructure:"command"`
+	// Timeout is how long the hook may run for before it is killed; HookTimeout if zero
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func (h TaskHook) name() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Command[0]
+}
+
+// HookError is returned when a pre-task hook fails, so the worker isn't run.
+type HookError struct {
+	Hook string
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("pre-task hook %v failed: %v", e.Hook, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// validateTaskHooks checks that each hook has a command.
+func validateTaskHooks(hooks []TaskHook) error {
+	for i, hook := range hooks {
+		if len(hook.Command) == 0 || hook.Command[0] == "" {
+			return fmt.Errorf("hook %v has no command", i+1)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("hook %v has a negative timeout", hook.name())
+		}
+	}
+	return nil
+}
+
+// hookEnv returns the environment for the agent's hooks: the agent's own, with
+// the hook's kind and details of the worker.
+func (a *Agent) hookEnv(kind string, imageURI string) []string {
+	return append(os.Environ(),
+		"RESIM_HOOK="+kind,
+		"RESIM_AGENT_NAME="+a.Name,
+		"RESIM_WORKER_ID="+a.currentWorkerID,
+		"RESIM_WORKER_IMAGE="+imageURI,
+		"RESIM_HOOK_STARTED_AT="+time.Now().UTC().Format(time.RFC3339),
+	)
+}
+
+// runHook runs a hook, logging its output, and fails if it exits non-zero or
+// runs for longer than its timeout.
+func (a *Agent) runHook(ctx context.Context, kind string, hook TaskHook, env []string) (err error) {
+	ctx, span := startSpan(ctx, "worker.hook", trace.WithAttributes(
+		attribute.String("hook.kind", kind),
+		attribute.String("hook.name", hook.name()),
+	))
+	defer func() { endSpan(span, err) }()
+
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = a.HookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	slog.Info("Running hook", "hook", hook.name(), "kind", kind, "worker", a.currentWorkerID)
+	hookStart := time.Now()
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = env
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimRight(string(output), "\n"), "\n") {
+		if line != "" {
+			slog.Info("Hook output", "hook", hook.name(), "output", line)
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	taskHookRunsTotal.WithLabelValues(kind, result).Inc()
+	slog.Info("Hook finished", "hook", hook.name(), "kind", kind, "result", result, "duration", time.Since(hookStart).Round(time.Millisecond), "err", err)
+	return err
+}
+
+// runPreTaskHooks runs the pre-task hooks in order, stopping at the first that
+// fails. If PreTaskHookFailureUnhealthy is set, a failure marks the rig
+// unhealthy, so the agent stops taking work until it is resumed.
+func (a *Agent) runPreTaskHooks(ctx context.Context, imageURI string) error {
+	if len(a.PreTaskHooks) == 0 {
+		return nil
+	}
+	env := a.hookEnv(hookPreTask, imageURI)
+	for _, hook := range a.PreTaskHooks {
+		err := a.runHook(ctx, hookPreTask, hook, env)
+		if err == nil {
+			continue
+		}
+		hookErr := &HookError{Hook: hook.name(), Err: err}
+		if a.PreTaskHookFailureUnhealthy {
+			a.markRigUnhealthy(hookErr.Error())
+		}
+		return hookErr
+	}
+	return nil
+}
+
+// runPostTaskHooks runs every post-task hook once the worker has finished, with
+// how it ended in their environment. Failures are logged, as the task is over.
+func (a *Agent) runPostTaskHooks(ctx context.Context, imageURI string, workerErr error, workerStart time.Time) {
+	if len(a.PostTaskHooks) == 0 {
+		return
+	}
+	env := a.hookEnv(hookPostTask, imageURI)
+	env = append(env, "RESIM_WORKER_FINISHED_AT="+time.Now().UTC().Format(time.RFC3339))
+	if !workerStart.IsZero() {
+		env = append(env, "RESIM_WORKER_STARTED_AT="+workerStart.UTC().Format(time.RFC3339))
+	}
+	var runErr *WorkerRunError
+	switch {
+	case workerErr == nil:
+		env = append(env, "RESIM_WORKER_OUTCOME="+string(WorkerOutcomeSucceeded), "RESIM_WORKER_EXIT_CODE=0")
+	case errors.As(workerErr, &runErr):
+		env = append(env, "RESIM_WORKER_OUTCOME="+string(runErr.Outcome), "RESIM_WORKER_EXIT_CODE="+strconv.Itoa(runErr.ExitCode))
+	}
+	for _, hook := range a.PostTaskHooks {
+		err := a.runHook(ctx, hookPostTask, hook, env)
+		if err != nil {
+			slog.Warn("Post-task hook failed", "hook", hook.name(), "err", err)
+		}
+	}
+}
+
+// markRigUnhealthy stops the agent taking work until it is resumed, e.g. as a
+// pre-task hook found that the rig's hardware isn't working.
+func (a *Agent) markRigUnhealthy(reason string) {
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.rigUnhealthy = reason
+	slog.Error("Rig is unhealthy, not taking work until the agent is resumed", "reason", reason)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeHookScript writes an executable shell script for a hook.
+func writeHookScript(t *testing.T, dir string, name string, script string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0700))
+	return path
+}
+
+// readHookEnv reads the RESIM_ variables written by a hook with env.
+func readHookEnv(t *testing.T, path string) map[string]string {
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	env := map[string]string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		key, value, found := strings.Cut(line, "=")
+		if found && strings.HasPrefix(key, "RESIM_") {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+func TestValidateTaskHooks(t *testing.T) {
+	assert.NoError(t, validateTaskHooks(nil))
+	assert.NoError(t, validateTaskHooks([]TaskHook{{Command: []string{"/opt/rig/power-cycle.sh", "--dut", "1"}, Timeout: time.Minute}}))
+	assert.ErrorContains(t, validateTaskHooks([]TaskHook{{Name: "power-cycle"}}), "hook 1 has no command")
+	assert.ErrorContains(t, validateTaskHooks([]TaskHook{{Command: []string{"/opt/rig/power-cycle.sh"}, Timeout: -time.Second}}), "negative timeout")
+}
+
+func TestRunPreTaskHooks(t *testing.T) {
+	dir := t.TempDir()
+	a := New(nil)
+	a.Name = "rig-1"
+	a.HookTimeout = time.Minute
+	a.currentWorkerID = "1234"
+	ctx := context.Background()
+
+	envPath := filepath.Join(dir, "env")
+	a.PreTaskHooks = []TaskHook{
+		{Name: "power-cycle", Command: []string{writeHookScript(t, dir, "power-cycle.sh", "env > "+envPath+"\n")}},
+		{Command: []string{"true"}},
+	}
+	assert.NoError(t, a.runPreTaskHooks(ctx, "worker:latest"))
+	env := readHookEnv(t, envPath)
+	assert.Equal(t, hookPreTask, env["RESIM_HOOK"])
+	assert.Equal(t, "rig-1", env["RESIM_AGENT_NAME"])
+	assert.Equal(t, "1234", env["RESIM_WORKER_ID"])
+	assert.Equal(t, "worker:latest", env["RESIM_WORKER_IMAGE"])
+	assert.NotEmpty(t, env["RESIM_HOOK_STARTED_AT"])
+
+	// A failing hook stops the hooks after it
+	markerPath := filepath.Join(dir, "marker")
+	a.PreTaskHooks = []TaskHook{
+		{Name: "flash", Command: []string{writeHookScript(t, dir, "flash.sh", "echo flashing failed\nexit 3\n")}},
+		{Command: []string{"touch", markerPath}},
+	}
+	err := a.runPreTaskHooks(ctx, "worker:latest")
+	var hookErr *HookError
+	assert.True(t, errors.As(err, &hookErr))
+	assert.Equal(t, "flash", hookErr.Hook)
+	assert.ErrorContains(t, err, "exit status 3")
+	assert.NoFileExists(t, markerPath)
+	assert.Empty(t, a.getState().rigUnhealthy, "the rig is only marked unhealthy if configured")
+
+	// Hooks are killed after their timeout
+	a.PreTaskHooks = []TaskHook{{Command: []string{"sleep", "10"}, Timeout: 100 * time.Millisecond}}
+	start := time.Now()
+	assert.ErrorContains(t, a.runPreTaskHooks(ctx, "worker:latest"), "timed out after 100ms")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestRunPreTaskHooksMarksRigUnhealthy(t *testing.T) {
+	a := New(nil)
+	a.HookTimeout = time.Minute
+	a.PreTaskHookFailureUnhealthy = true
+	a.PreTaskHooks = []TaskHook{{Name: "reset-can", Command: []string{"false"}}}
+
+	assert.Error(t, a.runPreTaskHooks(context.Background(), "worker:latest"))
+	state := a.getState()
+	assert.Contains(t, state.rigUnhealthy, "pre-task hook reset-can failed")
+	assert.False(t, rigHealth(state).OK)
+	assert.Equal(t, state.rigUnhealthy, a.CurrentStatus().RigUnhealthy)
+
+	// The agent waits until it is resumed
+	resumed := make(chan struct{})
+	go func() {
+		a.waitWhilePaused()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("agent took work while the rig was unhealthy")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.Resume()
+	<-resumed
+	assert.True(t, rigHealth(a.getState()).OK)
+}
+
+func TestRunPostTaskHooks(t *testing.T) {
+	dir := t.TempDir()
+	a := New(nil)
+	a.HookTimeout = time.Minute
+	a.currentWorkerID = "1234"
+	envPath := filepath.Join(dir, "env")
+	a.PostTaskHooks = []TaskHook{
+		{Command: []string{"false"}},
+		{Name: "collect-logs", Command: []string{writeHookScript(t, dir, "collect-logs.sh", "env > "+envPath+"\n")}},
+	}
+
+	workerStart := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	a.runPostTaskHooks(context.Background(), "worker:latest", &WorkerRunError{Outcome: WorkerOutcomeOOMKilled, ExitCode: 137}, workerStart)
+	env := readHookEnv(t, envPath)
+	assert.Equal(t, hookPostTask, env["RESIM_HOOK"], "later hooks run after a failure")
+	assert.Equal(t, "1234", env["RESIM_WORKER_ID"])
+	assert.Equal(t, string(WorkerOutcomeOOMKilled), env["RESIM_WORKER_OUTCOME"])
+	assert.Equal(t, "137", env["RESIM_WORKER_EXIT_CODE"])
+	assert.Equal(t, "2026-10-18T09:00:00Z", env["RESIM_WORKER_STARTED_AT"])
+	assert.NotEmpty(t, env["RESIM_WORKER_FINISHED_AT"])
+
+	a.runPostTaskHooks(context.Background(), "worker:latest", nil, workerStart)
+	env = readHookEnv(t, envPath)
+	assert.Equal(t, string(WorkerOutcomeSucceeded), env["RESIM_WORKER_OUTCOME"])
+	assert.Equal(t, "0", env["RESIM_WORKER_EXIT_CODE"])
+
+	// Workers that never started have no start time or exit status
+	a.runPostTaskHooks(context.Background(), "worker:latest", errors.New("error getting mounts"), time.Time{})
+	env = readHookEnv(t, envPath)
+	assert.NotContains(t, env, "RESIM_WORKER_STARTED_AT")
+	assert.NotContains(t, env, "RESIM_WORKER_OUTCOME")
+}
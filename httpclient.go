@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	// Where the worker's CA bundle is written in the worker directory, and where
+	// it is mounted in the worker
+	workerCABundleFilename = "ca-bundle.pem"
+	workerCABundlePath     = "/etc/resim/certs/ca-bundle.pem"
+)
+
+// systemCABundles are where Linux distributions keep the system's CA bundle, as
+// searched by crypto/x509.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu and Gentoo
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora and RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // OpenSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS and RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine
+}
+
+// HTTPConfig configures the agent's outbound HTTP(S) connections to the auth
+// server, the Agent API, GitHub and the tracing endpoint.
+type HTTPConfig struct {
+	// Proxies, overriding HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+	// PEM certificates trusted in addition to the system's, e.g. for a TLS-intercepting proxy
+	CABundle string
+	// A client certificate and key for mTLS
+	ClientCertificate string
+	ClientKey         string
+	// Timeout is the limit on each request, including reading the response
+	Timeout time.Duration
+}
+
+// proxyConfig returns the proxy configuration from the environment, with any
+// proxies from the agent's config taking precedence.
+func (c HTTPConfig) proxyConfig() *httpproxy.Config {
+	proxy := httpproxy.FromEnvironment()
+	if c.HTTPProxy != "" {
+		proxy.HTTPProxy = c.HTTPProxy
+	}
+	if c.HTTPSProxy != "" {
+		proxy.HTTPSProxy = c.HTTPSProxy
+	}
+	if c.NoProxy != "" {
+		proxy.NoProxy = c.NoProxy
+	}
+	return proxy
+}
+
+// proxyFunc returns the proxy to use for a request, if any.
+func (c HTTPConfig) proxyFunc() func(*http.Request) (*url.URL, error) {
+	proxyForURL := c.proxyConfig().ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyForURL(req.URL)
+	}
+}
+
+// tlsConfig returns the TLS configuration for the CA bundle and client
+// certificate, or nil if neither is set.
+func (c HTTPConfig) tlsConfig() (*tls.Config, error) {
+	if c.CABundle == "" && c.ClientCertificate == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %v", c.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.ClientCertificate != "" {
+		if c.ClientKey == "" {
+			return nil, errors.New("a client certificate requires a client key")
+		}
+		certificate, err := tls.LoadX509KeyPair(c.ClientCertificate, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// newHTTPClient returns the client for all of the agent's outbound HTTP(S)
+// requests.
+func newHTTPClient(c HTTPConfig) (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		Proxy: c.proxyFunc(),
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}, nil
+}
+
+// workerEnvVars returns the proxy and CA settings for the worker, so that it
+// connects in the same way as the agent. Both upper and lower case proxy
+// variables are set, as tools differ in which they read.
+func (c HTTPConfig) workerEnvVars() []string {
+	var envVars []string
+	proxy := c.proxyConfig()
+	for _, v := range []struct{ name, value string }{
+		{"HTTP_PROXY", proxy.HTTPProxy},
+		{"HTTPS_PROXY", proxy.HTTPSProxy},
+		{"NO_PROXY", proxy.NoProxy},
+	} {
+		if v.value == "" {
+			continue
+		}
+		envVars = append(envVars, v.name+"="+v.value, strings.ToLower(v.name)+"="+v.value)
+	}
+	if c.CABundle != "" {
+		envVars = append(envVars, "SSL_CERT_FILE="+workerCABundlePath)
+	}
+	return envVars
+}
+
+// writeWorkerCABundle writes the worker's CA bundle to path: the system's CA
+// bundle followed by the configured one. SSL_CERT_FILE replaces the system's
+// bundle for both Go and OpenSSL, so the worker is given both in one file.
+func (c HTTPConfig) writeWorkerCABundle(path string) error {
+	caBundle, err := os.ReadFile(c.CABundle)
+	if err != nil {
+		return fmt.Errorf("error reading CA bundle: %w", err)
+	}
+	var bundle []byte
+	for _, systemCABundle := range systemCABundles {
+		if systemBundle, err := os.ReadFile(systemCABundle); err == nil {
+			bundle = append(systemBundle, '\n')
+			break
+		}
+	}
+	bundle = append(bundle, caBundle...)
+	return os.WriteFile(path, bundle, 0644)
+}
+
+// workerCAMount writes the worker's CA bundle to dir, returning its mount in the
+// worker, if there is a CA bundle.
+func (c HTTPConfig) workerCAMount(dir string) (mount.Mount, bool, error) {
+	if c.CABundle == "" {
+		return mount.Mount{}, false, nil
+	}
+	path := filepath.Join(dir, workerCABundleFilename)
+	err := c.writeWorkerCABundle(path)
+	if err != nil {
+		return mount.Mount{}, false, err
+	}
+	return mount.Mount{Type: mount.TypeBind, Source: path, Target: workerCABundlePath, ReadOnly: true}, true, nil
+}
+
+// redactProxyURL masks the password in a proxy URL for logging and the effective
+// config.
+func redactProxyURL(proxy string) string {
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return proxy
+	}
+	return proxyURL.Redacted()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/opencontainers/go-digest"
+)
+
+// pullProgressInterval is how often progress is logged while pulling an image.
+const pullProgressInterval = 10 * time.Second
+
+// ImagePullPolicy is when to pull the worker image.
+type ImagePullPolicy string
+
+const (
+	// ImagePullPolicyAlways pulls the image, and pulls it again if its tag moves
+	ImagePullPolicyAlways ImagePullPolicy = "always"
+	// ImagePullPolicyIfNotPresent uses the image if it is present locally, and pulls it otherwise
+	ImagePullPolicyIfNotPresent ImagePullPolicy = "if-not-present"
+	// ImagePullPolicyNever only uses an image that is present locally, e.g. one loaded with docker load
+	ImagePullPolicyNever ImagePullPolicy = "never"
+)
+
+func parseImagePullPolicy(policy string) (ImagePullPolicy, error) {
+	switch ImagePullPolicy(policy) {
+	case ImagePullPolicyAlways, ImagePullPolicyIfNotPresent, ImagePullPolicyNever:
+		return ImagePullPolicy(policy), nil
+	default:
+		return ImagePullPolicyAlways, fmt.Errorf("invalid image pull policy %q: must be %v, %v or %v", policy, ImagePullPolicyAlways, ImagePullPolicyIfNotPresent, ImagePullPolicyNever)
+	}
+}
+
+// pulledImage is a worker image that has been pulled, and the digest it resolved
+// to, if the runtime reported one.
+type pulledImage struct {
+	URI    string
+	Digest string
+}
+
+// Ref returns the reference to run the image by: pinned to its digest if known,
+// so that the container runs exactly what was pulled even if the tag has since moved.
+func (p pulledImage) Ref() string {
+	if p.Digest == "" {
+		return p.URI
+	}
+	ref, err := digestReference(p.URI, p.Digest)
+	if err != nil {
+		slog.Warn("Error pinning image to its digest, using its tag", "image", p.URI, "digest", p.Digest, "err", err)
+		return p.URI
+	}
+	return ref
+}
+
+// digestReference replaces any tag or digest in imageURI with imageDigest.
+func digestReference(imageURI string, imageDigest string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageURI)
+	if err != nil {
+		return "", err
+	}
+	parsedDigest, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", err
+	}
+	canonical, err := reference.WithDigest(reference.TrimNamed(named), parsedDigest)
+	if err != nil {
+		return "", err
+	}
+	return canonical.String(), nil
+}
+
+// isDigestPinned reports whether imageURI already refers to an image by digest,
+// in which case it can't move.
+func isDigestPinned(imageURI string) bool {
+	named, err := reference.ParseNormalizedNamed(imageURI)
+	if err != nil {
+		return false
+	}
+	_, ok := named.(reference.Canonical)
+	return ok
+}
+
+// repoDigest returns the digest imageURI's repository knows the image by, from
+// an image's repo digests. Images that were loaded rather than pulled have none.
+func repoDigest(imageURI string, repoDigests []string) string {
+	named, err := reference.ParseNormalizedNamed(imageURI)
+	if err != nil {
+		return ""
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		return canonical.Digest().String()
+	}
+	for _, repoDigest := range repoDigests {
+		ref, err := reference.ParseNormalizedNamed(repoDigest)
+		if err != nil {
+			continue
+		}
+		if canonical, ok := ref.(reference.Canonical); ok && canonical.Name() == named.Name() {
+			return canonical.Digest().String()
+		}
+	}
+	return ""
+}
+
+// localImage returns imageURI if it is present locally for the agent's platform.
+func (a *Agent) localImage(ctx context.Context, imageURI string) (pulledImage, bool, error) {
+	inspect, _, err := a.Docker.ImageInspectWithRaw(ctx, imageURI)
+	if errdefs.IsNotFound(err) {
+		return pulledImage{}, false, nil
+	}
+	if err != nil {
+		return pulledImage{}, false, fmt.Errorf("error inspecting local image %v: %w", imageURI, err)
+	}
+	if a.Platform.OS != "" && (inspect.Os != a.Platform.OS || inspect.Architecture != a.Platform.Architecture) {
+		slog.Info("Local image is for another platform", "image", imageURI, "image_platform", inspect.Os+"/"+inspect.Architecture, "platform", formatPlatform(a.Platform))
+		return pulledImage{}, false, nil
+	}
+	return pulledImage{URI: imageURI, Digest: repoDigest(imageURI, inspect.RepoDigests)}, true, nil
+}
+
+// missingImageError explains that imageURI can't be used without pulling it,
+// listing the tags of its repository that are present, in case of a typo or an
+// out of date preloaded image.
+func (a *Agent) missingImageError(ctx context.Context, imageURI string) error {
+	err := fmt.Errorf("worker image %v is not present locally for %v, and %v is %v", imageURI, formatPlatform(a.Platform), ImagePullPolicyKey, ImagePullPolicyNever)
+	named, parseErr := reference.ParseNormalizedNamed(imageURI)
+	if parseErr != nil {
+		return err
+	}
+	images, listErr := a.Docker.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", reference.FamiliarName(named))),
+	})
+	if listErr != nil {
+		slog.Warn("Error listing local images", "err", listErr)
+		return err
+	}
+	var tags []string
+	for _, i := range images {
+		tags = append(tags, i.RepoTags...)
+	}
+	if len(tags) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w (present locally: %v)", err, strings.Join(tags, ", "))
+}
+
+// remoteImageDigest asks the registry, via the runtime, which digest imageURI
+// currently refers to, without pulling it.
+func (a *Agent) remoteImageDigest(ctx context.Context, imageURI string) (string, error) {
+	inspect, err := a.Docker.DistributionInspect(ctx, imageURI, a.registryAuth(imageURI))
+	if err != nil {
+		return "", err
+	}
+	if inspect.Descriptor.Digest == "" {
+		return "", fmt.Errorf("registry returned no digest for %v", imageURI)
+	}
+	return inspect.Descriptor.Digest.String(), nil
+}
+
+// pullImage pulls imageURI for the agent's platform with the registry's
+// credentials. If the registry rejects them, they are looked up again and the
+// pull retried once, as short-lived tokens may have expired.
+func (a *Agent) pullImage(ctx context.Context, imageURI string) (pullProgress, error) {
+	progress, err := a.pullImageOnce(ctx, imageURI)
+	if isRegistryAuthError(err) && a.RegistryAuthenticator != nil {
+		slog.Info("Registry rejected the credentials, refreshing them and retrying", "image", imageURI, "err", err)
+		a.RegistryAuthenticator.Invalidate(imageURI)
+		progress, err = a.pullImageOnce(ctx, imageURI)
+	}
+	return progress, wrapPlatformError(err, imageURI, a.Platform)
+}
+
+func (a *Agent) pullImageOnce(ctx context.Context, imageURI string) (pullProgress, error) {
+	r, err := a.Docker.ImagePull(ctx, imageURI, image.PullOptions{
+		Platform:     formatPlatform(a.Platform),
+		RegistryAuth: a.registryAuth(imageURI),
+	})
+	if err != nil {
+		return pullProgress{}, err
+	}
+	defer r.Close()
+	return readPullProgress(imageURI, &progressReader{Reader: r, recordProgress: a.recordProgress})
+}
+
+// progressReader records the agent loop's progress whenever an image pull's
+// progress stream is read, so that a long pull doesn't make the agent unhealthy.
+type progressReader struct {
+	io.Reader
+	recordProgress func()
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	r.recordProgress()
+	return r.Reader.Read(p)
+}
+
+// pullProgress is what was learned from an image pull's progress stream.
+type pullProgress struct {
+	// Bytes is the total size of the layers that were downloaded
+	Bytes int64
+	// Digest is the digest the image resolved to
+	Digest string
+}
+
+// readPullProgress drains an image pull progress stream, logging progress
+// periodically. It returns the error reported in the stream if the pull failed,
+// as the pull request itself succeeds once the stream starts. Malformed messages
+// are ignored.
+func readPullProgress(imageURI string, r io.Reader) (pullProgress, error) {
+	var progress pullProgress
+	layerSizes := map[string]int64{}
+	layerDownloaded := map[string]int64{}
+	layersComplete := map[string]bool{}
+	lastLogged := time.Now()
+	var pullErr error
+	decoder := json.NewDecoder(r)
+	for {
+		var message struct {
+			ID             string `json:"id"`
+			Status         string `json:"status"`
+			Error          string `json:"error"`
+			ProgressDetail struct {
+				Current int64 `json:"current"`
+				Total   int64 `json:"total"`
+			} `json:"progressDetail"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			break
+		}
+		if message.Error != "" && pullErr == nil {
+			pullErr = errors.New(message.Error)
+		}
+		switch {
+		case message.Status == "Downloading" && message.ProgressDetail.Total > 0:
+			layerSizes[message.ID] = message.ProgressDetail.Total
+			layerDownloaded[message.ID] = message.ProgressDetail.Current
+		case message.Status == "Pull complete" || message.Status == "Already exists":
+			layersComplete[message.ID] = true
+		case strings.HasPrefix(message.Status, "Digest: "):
+			progress.Digest = strings.TrimPrefix(message.Status, "Digest: ")
+		}
+		if message.Status != "" && message.ID != "" {
+			slog.Debug("Image pull progress", "image", imageURI, "layer", message.ID, "status", message.Status)
+		}
+		if time.Since(lastLogged) >= pullProgressInterval {
+			lastLogged = time.Now()
+			var downloaded, total int64
+			for id, size := range layerSizes {
+				downloaded += layerDownloaded[id]
+				total += size
+			}
+			slog.Info("Pulling image", "image", imageURI, "downloaded_bytes", downloaded, "total_bytes", total, "layers_complete", len(layersComplete))
+		}
+	}
+	// Drain anything left after a decode error so the pull completes
+	io.Copy(io.Discard, io.MultiReader(decoder.Buffered(), r))
+
+	for _, size := range layerSizes {
+		progress.Bytes += size
+	}
+	if pullErr == nil && progress.Digest != "" {
+		if _, err := digest.Parse(progress.Digest); err != nil {
+			pullErr = fmt.Errorf("invalid digest %q for pulled image: %w", progress.Digest, err)
+		}
+	}
+	return progress, pullErr
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/errdefs"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const (
+	testDigest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	testDigest2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestReadPullProgress(t *testing.T) {
+	stream := strings.NewReader(`{"status":"Pulling from resim/experience-worker","id":"latest"}
+{"status":"Pulling fs layer","progressDetail":{},"id":"layer1"}
+{"status":"Downloading","progressDetail":{"current":100,"total":1000},"id":"layer1"}
+{"status":"Downloading","progressDetail":{"current":1000,"total":1000},"id":"layer1"}
+{"status":"Download complete","progressDetail":{},"id":"layer1"}
+{"status":"Pull complete","progressDetail":{},"id":"layer1"}
+{"status":"Downloading","progressDetail":{"current":20,"total":500},"id":"layer2"}
+{"status":"Digest: ` + testDigest1 + `"}
+{"status":"Status: Downloaded newer image for public.ecr.aws/resim/experience-worker:latest"}
+`)
+	progress, err := readPullProgress("public.ecr.aws/resim/experience-worker:latest", stream)
+	assert.NoError(t, err)
+	assert.Equal(t, pullProgress{Bytes: 1500, Digest: testDigest1}, progress)
+
+	// Non-JSON streams are drained without counting anything
+	nonJSON := strings.NewReader("thing")
+	progress, err = readPullProgress("thing", nonJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, pullProgress{}, progress)
+	remaining, _ := io.ReadAll(nonJSON)
+	assert.Empty(t, remaining)
+
+	// Errors are reported in the stream rather than by the pull request failing
+	failed := strings.NewReader(`{"status":"Pulling from resim/experience-worker","id":"latest"}
+{"errorDetail":{"message":"no matching manifest for linux/arm64/v8 in the manifest list entries"},"error":"no matching manifest for linux/arm64/v8 in the manifest list entries"}
+`)
+	_, err = readPullProgress("public.ecr.aws/resim/experience-worker:latest", failed)
+	assert.EqualError(t, err, "no matching manifest for linux/arm64/v8 in the manifest list entries")
+
+	invalidDigest := strings.NewReader(`{"status":"Digest: sha256:nope"}`)
+	_, err = readPullProgress("public.ecr.aws/resim/experience-worker:latest", invalidDigest)
+	assert.ErrorContains(t, err, "invalid digest")
+}
+
+func TestPulledImageRef(t *testing.T) {
+	for _, tc := range []struct {
+		image    pulledImage
+		expected string
+	}{
+		{pulledImage{URI: "public.ecr.aws/resim/experience-worker:latest"}, "public.ecr.aws/resim/experience-worker:latest"},
+		{pulledImage{URI: "public.ecr.aws/resim/experience-worker:latest", Digest: testDigest1}, "public.ecr.aws/resim/experience-worker@" + testDigest1},
+		{pulledImage{URI: "localhost:5000/worker:v1", Digest: testDigest1}, "localhost:5000/worker@" + testDigest1},
+		{pulledImage{URI: "localhost:5000/worker@" + testDigest2, Digest: testDigest1}, "localhost:5000/worker@" + testDigest1},
+		{pulledImage{URI: "ubuntu", Digest: testDigest1}, "docker.io/library/ubuntu@" + testDigest1},
+		{pulledImage{URI: "worker:latest", Digest: "not-a-digest"}, "worker:latest"},
+	} {
+		assert.Equal(t, tc.expected, tc.image.Ref(), tc.image)
+	}
+
+	assert.True(t, isDigestPinned("localhost:5000/worker@"+testDigest1))
+	assert.False(t, isDigestPinned("localhost:5000/worker:v1"))
+}
+
+func pullStream(imageDigest string) io.ReadCloser {
+	return io.NopCloser(strings.NewReader(`{"status":"Digest: ` + imageDigest + `"}`))
+}
+
+func TestMaybePullImage(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Platform = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	a.WorkerImageURI = "public.ecr.aws/resim/experience-worker:latest"
+	ctx := context.Background()
+	pullOptions := image.PullOptions{Platform: "linux/amd64"}
+
+	// First pull records the digest
+	mockDocker.On("ImagePull", mock.Anything, a.WorkerImageURI, pullOptions).Return(pullStream(testDigest1), nil).Once()
+	pulled, err := a.maybePullImage(ctx, pulledImage{})
+	assert.NoError(t, err)
+	assert.Equal(t, pulledImage{URI: a.WorkerImageURI, Digest: testDigest1}, pulled)
+
+	// The tag hasn't moved, so there's no need to pull
+	inspect := registry.DistributionInspect{}
+	inspect.Descriptor.Digest = testDigest1
+	mockDocker.On("DistributionInspect", mock.Anything, a.WorkerImageURI, "").Return(inspect, nil).Once()
+	pulled, err = a.maybePullImage(ctx, pulled)
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest1, pulled.Digest)
+
+	// The registry can't be reached, so the last pulled image is used
+	mockDocker.On("DistributionInspect", mock.Anything, a.WorkerImageURI, "").Return(registry.DistributionInspect{}, errors.New("connection refused")).Once()
+	pulled, err = a.maybePullImage(ctx, pulled)
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest1, pulled.Digest)
+
+	// The tag has moved to a new image, so it is pulled again
+	inspect.Descriptor.Digest = testDigest2
+	mockDocker.On("DistributionInspect", mock.Anything, a.WorkerImageURI, "").Return(inspect, nil).Once()
+	mockDocker.On("ImagePull", mock.Anything, a.WorkerImageURI, pullOptions).Return(pullStream(testDigest2), nil).Once()
+	pulled, err = a.maybePullImage(ctx, pulled)
+	assert.NoError(t, err)
+	assert.Equal(t, pulledImage{URI: a.WorkerImageURI, Digest: testDigest2}, pulled)
+	assert.Equal(t, "public.ecr.aws/resim/experience-worker@"+testDigest2, pulled.Ref())
+
+	// A failed pull keeps the last pulled image
+	a.WorkerImageURI = "public.ecr.aws/resim/experience-worker:v2"
+	mockDocker.On("ImagePull", mock.Anything, a.WorkerImageURI, pullOptions).Return(io.NopCloser(strings.NewReader(`{"error":"manifest unknown"}`)), nil).Once()
+	last := pulled
+	pulled, err = a.maybePullImage(ctx, last)
+	assert.EqualError(t, err, "manifest unknown")
+	assert.Equal(t, last, pulled)
+}
+
+func TestParseImagePullPolicy(t *testing.T) {
+	for _, policy := range []ImagePullPolicy{ImagePullPolicyAlways, ImagePullPolicyIfNotPresent, ImagePullPolicyNever} {
+		parsed, err := parseImagePullPolicy(string(policy))
+		assert.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := parseImagePullPolicy("sometimes")
+	assert.ErrorContains(t, err, "invalid image pull policy")
+}
+
+func TestRepoDigest(t *testing.T) {
+	repoDigests := []string{
+		"localhost:5000/worker@" + testDigest2,
+		"public.ecr.aws/resim/experience-worker@" + testDigest1,
+	}
+	assert.Equal(t, testDigest1, repoDigest("public.ecr.aws/resim/experience-worker:latest", repoDigests))
+	assert.Equal(t, testDigest2, repoDigest("localhost:5000/worker:v1", repoDigests))
+	assert.Equal(t, testDigest2, repoDigest("public.ecr.aws/resim/experience-worker@"+testDigest2, repoDigests))
+	assert.Equal(t, "", repoDigest("loaded-worker:v1", repoDigests))
+	assert.Equal(t, testDigest1, repoDigest("ubuntu:24.04", []string{"ubuntu@" + testDigest1}))
+}
+
+func TestMaybePullImagePolicy(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Platform = ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	a.WorkerImageURI = "public.ecr.aws/resim/experience-worker:latest"
+	ctx := context.Background()
+	notFound := errdefs.NotFound(errors.New("No such image"))
+
+	// Present locally, so it isn't pulled
+	a.ImagePullPolicy = ImagePullPolicyIfNotPresent
+	mockDocker.On("ImageInspectWithRaw", mock.Anything, a.WorkerImageURI).Return(types.ImageInspect{
+		Os:           "linux",
+		Architecture: "arm64",
+		RepoDigests:  []string{"public.ecr.aws/resim/experience-worker@" + testDigest1},
+	}, nil).Once()
+	pulled, err := a.maybePullImage(ctx, pulledImage{})
+	assert.NoError(t, err)
+	assert.Equal(t, pulledImage{URI: a.WorkerImageURI, Digest: testDigest1}, pulled)
+
+	// The registry isn't checked for a moved tag
+	pulled, err = a.maybePullImage(ctx, pulled)
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest1, pulled.Digest)
+
+	// Present locally but for another platform, so it is pulled
+	a.WorkerImageURI = "public.ecr.aws/resim/experience-worker:v2"
+	mockDocker.On("ImageInspectWithRaw", mock.Anything, a.WorkerImageURI).Return(types.ImageInspect{Os: "linux", Architecture: "amd64"}, nil).Once()
+	mockDocker.On("ImagePull", mock.Anything, a.WorkerImageURI, image.PullOptions{Platform: "linux/arm64"}).Return(pullStream(testDigest2), nil).Once()
+	pulled, err = a.maybePullImage(ctx, pulled)
+	assert.NoError(t, err)
+	assert.Equal(t, pulledImage{URI: a.WorkerImageURI, Digest: testDigest2}, pulled)
+
+	// Not present, and never pulled
+	a.ImagePullPolicy = ImagePullPolicyNever
+	a.WorkerImageURI = "public.ecr.aws/resim/experience-worker:v3"
+	mockDocker.On("ImageInspectWithRaw", mock.Anything, a.WorkerImageURI).Return(types.ImageInspect{}, notFound).Once()
+	mockDocker.On("ImageList", mock.Anything, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", "public.ecr.aws/resim/experience-worker")),
+	}).Return([]image.Summary{{RepoTags: []string{"public.ecr.aws/resim/experience-worker:v2"}}}, nil).Once()
+	last := pulled
+	pulled, err = a.maybePullImage(ctx, last)
+	assert.EqualError(t, err, "worker image public.ecr.aws/resim/experience-worker:v3 is not present locally for linux/arm64, and image-pull-policy is never (present locally: public.ecr.aws/resim/experience-worker:v2)")
+	assert.Equal(t, last, pulled)
+
+	// A loaded image has no repo digest, so is run by its tag
+	a.WorkerImageURI = "worker:offline"
+	mockDocker.On("ImageInspectWithRaw", mock.Anything, a.WorkerImageURI).Return(types.ImageInspect{Os: "linux", Architecture: "arm64"}, nil).Once()
+	pulled, err = a.maybePullImage(ctx, last)
+	assert.NoError(t, err)
+	assert.Equal(t, "worker:offline", pulled.Ref())
+}
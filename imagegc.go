@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"syscall"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+)
+
+// collectWorkerImages removes old worker images, so that the disk doesn't fill
+// up as ReSim releases new ones. It runs after a new worker image has run
+// successfully, or after any run when the container runtime's disk is fuller than
+// ImageGCDiskThreshold, and keeps the ImageRetentionCount most recent worker
+// images, including the current one, and any used by containers.
+func (a *Agent) collectWorkerImages(ctx context.Context, current pulledImage, newImage bool) {
+	if a.ImageRetentionCount <= 0 || current.URI == "" {
+		return
+	}
+	if !newImage {
+		if a.ImageGCDiskThreshold <= 0 {
+			return
+		}
+		usage, err := a.runtimeDiskUsagePercent(ctx)
+		if err != nil {
+			slog.Debug("Error checking the container runtime's disk usage", "err", err)
+			return
+		}
+		if usage < float64(a.ImageGCDiskThreshold) {
+			return
+		}
+		slog.Info("Container runtime disk usage is over the threshold, removing old worker images", "usage_percent", usage, "threshold_percent", a.ImageGCDiskThreshold)
+	}
+
+	removed, err := a.removeOldWorkerImages(ctx, current)
+	if err != nil {
+		slog.Warn("Error removing old worker images", "err", err)
+	}
+	if removed > 0 {
+		slog.Info("Removed old worker images", "count", removed, "kept", a.ImageRetentionCount)
+	}
+}
+
+// removeOldWorkerImages removes images of the current worker image's repository
+// beyond the ImageRetentionCount most recently created, returning how many were
+// removed. Images that can't be removed, e.g. as another tag refers to them, are
+// skipped.
+func (a *Agent) removeOldWorkerImages(ctx context.Context, current pulledImage) (int, error) {
+	named, err := reference.ParseNormalizedNamed(current.URI)
+	if err != nil {
+		return 0, err
+	}
+	images, err := a.Docker.ImageList(ctx, image.ListOptions{
+		Filters:        filters.NewArgs(filters.Arg("reference", reference.FamiliarName(named))),
+		ContainerCount: true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error listing worker images: %w", err)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Created > images[j].Created
+	})
+
+	currentRefs := map[string]bool{
+		reference.FamiliarString(named): true,
+		current.Ref():                   true,
+	}
+	if currentDigest, err := reference.ParseNormalizedNamed(current.Ref()); err == nil {
+		currentRefs[reference.FamiliarString(currentDigest)] = true
+	}
+	isCurrent := func(summary image.Summary) bool {
+		for _, ref := range slices.Concat(summary.RepoTags, summary.RepoDigests) {
+			if currentRefs[ref] {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The current image is always kept, and counts towards those retained
+	kept := 1
+	removed := 0
+	for _, summary := range images {
+		if isCurrent(summary) {
+			continue
+		}
+		if kept < a.ImageRetentionCount {
+			kept++
+			continue
+		}
+		if summary.Containers > 0 {
+			slog.Debug("Keeping worker image used by containers", "image", summary.ID, "tags", summary.RepoTags)
+			continue
+		}
+		_, err := a.Docker.ImageRemove(ctx, summary.ID, image.RemoveOptions{PruneChildren: true})
+		if err != nil {
+			slog.Warn("Error removing old worker image", "image", summary.ID, "tags", summary.RepoTags, "err", err)
+			continue
+		}
+		slog.Info("Removed old worker image", "image", summary.ID, "tags", summary.RepoTags, "bytes", summary.Size)
+		workerImagesRemovedTotal.Inc()
+		removed++
+	}
+	return removed, nil
+}
+
+// checkRuntimeDiskUsage warns on startup if the container runtime's disk usage
+// can't be read, e.g. as the agent is containerised, in which case old worker
+// images are only removed after a new worker image runs, however full the disk is.
+func (a *Agent) checkRuntimeDiskUsage(ctx context.Context) {
+	if a.ImageGCDiskThreshold <= 0 || a.ImageRetentionCount <= 0 {
+		return
+	}
+	_, err := a.runtimeDiskUsagePercent(ctx)
+	if err != nil {
+		slog.Warn("Can't read the container runtime's disk usage, so old worker images won't be removed when the disk fills", "threshold_percent", a.ImageGCDiskThreshold, "err", err)
+	}
+}
+
+// runtimeDiskUsagePercent returns how full the filesystem holding the container
+// runtime's images is. It must be visible to the agent, so this isn't available
+// when the agent is containerised or the runtime is remote.
+func (a *Agent) runtimeDiskUsagePercent(ctx context.Context) (float64, error) {
+	info, err := a.Docker.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if info.DockerRootDir == "" {
+		return 0, fmt.Errorf("container runtime did not report its root directory")
+	}
+	return diskUsagePercent(info.DockerRootDir)
+}
+
+func diskUsagePercent(dir string) (float64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, fmt.Errorf("%v has no blocks", dir)
+	}
+	return 100 * (1 - float64(stat.Bavail)/float64(stat.Blocks)), nil
+}
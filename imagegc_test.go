@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/system"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCollectWorkerImages(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.ImageRetentionCount = 2
+	a.ImageGCDiskThreshold = 85
+	ctx := context.Background()
+	current := pulledImage{URI: "public.ecr.aws/resim/experience-worker:v4", Digest: testDigest1}
+
+	images := []image.Summary{
+		{ID: "sha256:v1", Created: 1, RepoTags: []string{"public.ecr.aws/resim/experience-worker:v1"}},
+		{ID: "sha256:v2", Created: 2, RepoTags: []string{"public.ecr.aws/resim/experience-worker:v2"}, Containers: 1},
+		{ID: "sha256:v3", Created: 3, RepoTags: []string{"public.ecr.aws/resim/experience-worker:v3"}},
+		// The current image, pulled before v5 was built
+		{ID: "sha256:v4", Created: 4, RepoDigests: []string{"public.ecr.aws/resim/experience-worker@" + testDigest1}},
+		{ID: "sha256:v5", Created: 5, RepoTags: []string{"public.ecr.aws/resim/experience-worker:v5"}},
+		{ID: "sha256:v0", Created: 0, RepoTags: []string{"public.ecr.aws/resim/experience-worker:v0"}},
+	}
+	mockDocker.On("ImageList", mock.Anything, mock.MatchedBy(func(options image.ListOptions) bool {
+		return options.Filters.Get("reference")[0] == "public.ecr.aws/resim/experience-worker" && options.ContainerCount
+	})).Return(images, nil).Once()
+	// v4 is current and v5 the most recent other, so v3, v1 and v0 are removed,
+	// but v2 is kept as it is in use
+	removeOptions := image.RemoveOptions{PruneChildren: true}
+	mockDocker.On("ImageRemove", mock.Anything, "sha256:v3", removeOptions).Return([]image.DeleteResponse{}, nil).Once()
+	mockDocker.On("ImageRemove", mock.Anything, "sha256:v1", removeOptions).Return([]image.DeleteResponse{}, errors.New("image is referenced in multiple repositories")).Once()
+	mockDocker.On("ImageRemove", mock.Anything, "sha256:v0", removeOptions).Return([]image.DeleteResponse{}, nil).Once()
+
+	removed, err := a.removeOldWorkerImages(ctx, current)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	// The same image has run again, and the disk isn't full, so nothing is removed
+	mockDocker.On("Info", mock.Anything).Return(system.Info{DockerRootDir: os.TempDir()}, nil).Once()
+	a.ImageGCDiskThreshold = 100
+	a.collectWorkerImages(ctx, current, false)
+
+	// The disk is full enough to remove images after any run
+	usage, err := diskUsagePercent(os.TempDir())
+	assert.NoError(t, err)
+	if usage >= 1 {
+		mockDocker.On("Info", mock.Anything).Return(system.Info{DockerRootDir: os.TempDir()}, nil).Once()
+		mockDocker.On("ImageList", mock.Anything, mock.Anything).Return([]image.Summary{}, nil).Once()
+		a.ImageGCDiskThreshold = int(usage)
+		a.collectWorkerImages(ctx, current, false)
+	}
+
+	// A threshold of 0 disables removing images other than after a new image has run
+	a.ImageGCDiskThreshold = 0
+	a.collectWorkerImages(ctx, current, false)
+
+	// Disabled
+	a.ImageRetentionCount = 0
+	a.collectWorkerImages(ctx, current, true)
+}
+
+func TestDiskUsagePercent(t *testing.T) {
+	usage, err := diskUsagePercent(os.TempDir())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, usage, 0.0)
+	assert.LessOrEqual(t, usage, 100.0)
+
+	_, err = diskUsagePercent("/not/a/real/path")
+	assert.Error(t, err)
+}
+
+func TestCheckRuntimeDiskUsage(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.ImageRetentionCount = 3
+	a.ImageGCDiskThreshold = 85
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	mockDocker.On("Info", mock.Anything).Return(system.Info{DockerRootDir: os.TempDir()}, nil).Once()
+	a.checkRuntimeDiskUsage(context.Background())
+	assert.Empty(t, logs.String())
+
+	// e.g. the agent is containerised, so the runtime's root directory isn't visible
+	mockDocker.On("Info", mock.Anything).Return(system.Info{DockerRootDir: "/var/lib/docker-not-mounted"}, nil).Once()
+	a.checkRuntimeDiskUsage(context.Background())
+	assert.Contains(t, logs.String(), "level=WARN msg=\"Can't read the container runtime's disk usage")
+
+	// Not checked when the threshold is disabled
+	a.ImageGCDiskThreshold = 0
+	a.checkRuntimeDiskUsage(context.Background())
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type LogFormat string
+
+const (
+	LogFormatText LogFormat = "text"
+	LogFormatJSON LogFormat = "json"
+)
+
+type LogDestination string
+
+const (
+	LogDestinationStdout LogDestination = "stdout"
+	LogDestinationStderr LogDestination = "stderr"
+	LogDestinationFile   LogDestination = "file"
+	LogDestinationSyslog LogDestination = "syslog"
+)
+
+var LogDestinationsDefault = []string{string(LogDestinationStdout), string(LogDestinationFile)}
+
+func parseLogFormat(format string) (LogFormat, error) {
+	switch LogFormat(format) {
+	case LogFormatText, LogFormatJSON:
+		return LogFormat(format), nil
+	default:
+		return LogFormatText, fmt.Errorf("invalid log format %q: must be %v or %v", format, LogFormatText, LogFormatJSON)
+	}
+}
+
+func parseLogDestinations(destinations []string) ([]LogDestination, error) {
+	if len(destinations) == 0 {
+		return nil, errors.New("log destinations must include at least one destination")
+	}
+	var parsed []LogDestination
+	for _, destination := range destinations {
+		switch LogDestination(destination) {
+		case LogDestinationStdout, LogDestinationStderr, LogDestinationFile, LogDestinationSyslog:
+			parsed = append(parsed, LogDestination(destination))
+		default:
+			return nil, fmt.Errorf("invalid log destination %q: must be one of %v, %v, %v or %v",
+				destination, LogDestinationStdout, LogDestinationStderr, LogDestinationFile, LogDestinationSyslog)
+		}
+	}
+	return parsed, nil
+}
+
+func (a *Agent) getLogDir() string {
+	if a.LogDirOverride != "" {
+		return a.LogDirOverride
+	}
+	userHomeDir, _ := os.UserHomeDir()
+	return filepath.Join(userHomeDir, "resim")
+}
+
+func (a *Agent) newLogFileWriter() (io.Writer, error) {
+	logFileWriter := &lumberjack.Logger{
+		Filename:   fmt.Sprintf("%v/agent.log", a.getLogDir()),
+		MaxSize:    viper.GetInt(LogFilesizeKey),
+		MaxBackups: viper.GetInt(LogMaxBackupsKey),
+		MaxAge:     viper.GetInt(LogMaxAgeKey),
+		Compress:   viper.GetBool(LogCompressKey),
+	}
+
+	// test write to check permissions on the file; JSON logs must only contain
+	// records, so the version is only written to text logs
+	banner := ""
+	if a.LogFormat != LogFormatJSON {
+		banner = fmt.Sprintf("ReSim Agent %v\n", agentVersion)
+	}
+	_, err := io.WriteString(logFileWriter, banner)
+	if err != nil {
+		return nil, err
+	}
+	return logFileWriter, nil
+}
+
+// newSyslogWriter connects to the local syslog daemon (which is journald on most
+// systemd hosts), or to a remote one if an address such as udp://host:514 is configured.
+func newSyslogWriter() (*syslog.Writer, error) {
+	var network, address string
+	if rawAddress := viper.GetString(LogSyslogAddressKey); rawAddress != "" {
+		syslogURL, err := url.Parse(rawAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", LogSyslogAddressKey, err)
+		}
+		network, address = syslogURL.Scheme, syslogURL.Host
+	}
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_DAEMON, "resim-agent")
+}
+
+// syslogLevelWriter is the part of *syslog.Writer that writes at a given priority.
+type syslogLevelWriter interface {
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+	Debug(m string) error
+}
+
+// syslogPriorityWriter adapts one of a syslogLevelWriter's methods to an io.Writer.
+type syslogPriorityWriter func(m string) error
+
+func (w syslogPriorityWriter) Write(p []byte) (int, error) {
+	if err := w(string(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SyslogHandler writes records to syslog at the priority matching their level,
+// so that journald and syslog servers can filter the agent's errors and warnings.
+type SyslogHandler struct {
+	err     slog.Handler
+	warning slog.Handler
+	info    slog.Handler
+	debug   slog.Handler
+}
+
+// NewSyslogHandler returns a SyslogHandler that formats records with the handlers
+// made by newHandler.
+func NewSyslogHandler(writer syslogLevelWriter, newHandler func(io.Writer) slog.Handler) *SyslogHandler {
+	return &SyslogHandler{
+		err:     newHandler(syslogPriorityWriter(writer.Err)),
+		warning: newHandler(syslogPriorityWriter(writer.Warning)),
+		info:    newHandler(syslogPriorityWriter(writer.Info)),
+		debug:   newHandler(syslogPriorityWriter(writer.Debug)),
+	}
+}
+
+func (h *SyslogHandler) handlerFor(level slog.Level) slog.Handler {
+	switch {
+	case level >= slog.LevelError:
+		return h.err
+	case level >= slog.LevelWarn:
+		return h.warning
+	case level >= slog.LevelInfo:
+		return h.info
+	default:
+		return h.debug
+	}
+}
+
+func (h *SyslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handlerFor(level).Enabled(ctx, level)
+}
+
+func (h *SyslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handlerFor(record.Level).Handle(ctx, record)
+}
+
+func (h *SyslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &SyslogHandler{
+		err:     h.err.WithAttrs(attrs),
+		warning: h.warning.WithAttrs(attrs),
+		info:    h.info.WithAttrs(attrs),
+		debug:   h.debug.WithAttrs(attrs),
+	}
+}
+
+func (h *SyslogHandler) WithGroup(name string) slog.Handler {
+	return &SyslogHandler{
+		err:     h.err.WithGroup(name),
+		warning: h.warning.WithGroup(name),
+		info:    h.info.WithGroup(name),
+		debug:   h.debug.WithGroup(name),
+	}
+}
+
+func (a *Agent) InitializeLogging() error {
+	destinations := a.LogDestinations
+	if destinations == nil {
+		destinations = []LogDestination{LogDestinationStdout, LogDestinationFile}
+	}
+
+	var logWriters []io.Writer
+	var syslogWriter *syslog.Writer
+	for _, destination := range destinations {
+		switch destination {
+		case LogDestinationStdout:
+			logWriters = append(logWriters, os.Stdout)
+		case LogDestinationStderr:
+			logWriters = append(logWriters, os.Stderr)
+		case LogDestinationFile:
+			logFileWriter, err := a.newLogFileWriter()
+			if err != nil {
+				return err
+			}
+			logWriters = append(logWriters, logFileWriter)
+		case LogDestinationSyslog:
+			var err error
+			syslogWriter, err = newSyslogWriter()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var slogLevel slog.Level
+	switch a.LogLevel {
+	case "debug":
+		slogLevel = slog.LevelDebug
+	case "info":
+		slogLevel = slog.LevelInfo
+	case "error":
+		slogLevel = slog.LevelError
+	case "warn":
+		slogLevel = slog.LevelWarn
+	default:
+		slog.Warn("invalid log level set in config")
+		slogLevel = slog.LevelDebug
+	}
+
+	handlerOptions := &slog.HandlerOptions{Level: slogLevel}
+	newHandler := func(w io.Writer) slog.Handler {
+		if a.LogFormat == LogFormatJSON {
+			return slog.NewJSONHandler(w, handlerOptions)
+		}
+		return slog.NewTextHandler(w, handlerOptions)
+	}
+	var handlers []slog.Handler
+	if len(logWriters) > 0 {
+		handlers = append(handlers, newHandler(io.MultiWriter(logWriters...)))
+	}
+	if syslogWriter != nil {
+		handlers = append(handlers, NewSyslogHandler(syslogWriter, newHandler))
+	}
+	logHandler := slog.NewMultiHandler(handlers...)
+	logger := slog.New(NewRedactingHandler(logHandler, a.Redactor))
+	slog.SetDefault(logger)
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSyslogWriter records the priority of each message written to it.
+type fakeSyslogWriter struct {
+	messages []string
+}
+
+func (w *fakeSyslogWriter) write(priority string, m string) error {
+	w.messages = append(w.messages, fmt.Sprintf("%v: %v", priority, m))
+	return nil
+}
+
+func (w *fakeSyslogWriter) Err(m string) error     { return w.write("err", m) }
+func (w *fakeSyslogWriter) Warning(m string) error { return w.write("warning", m) }
+func (w *fakeSyslogWriter) Info(m string) error    { return w.write("info", m) }
+func (w *fakeSyslogWriter) Debug(m string) error   { return w.write("debug", m) }
+
+func TestSyslogHandlerPriorities(t *testing.T) {
+	writer := &fakeSyslogWriter{}
+	handler := NewSyslogHandler(writer, func(w io.Writer) slog.Handler {
+		return slog.NewTextHandler(w, &slog.HandlerOptions{
+			Level: slog.LevelDebug,
+			ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+				if attr.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return attr
+			},
+		})
+	})
+	logger := slog.New(handler).With("agent", "rig-1")
+
+	logger.Error("worker failed")
+	logger.Warn("retrying")
+	logger.Info("checked in")
+	logger.Debug("polling")
+	logger.Log(context.Background(), slog.LevelError+4, "critical")
+
+	assert.Equal(t, []string{
+		"err: level=ERROR msg=\"worker failed\" agent=rig-1\n",
+		"warning: level=WARN msg=retrying agent=rig-1\n",
+		"info: level=INFO msg=\"checked in\" agent=rig-1\n",
+		"debug: level=DEBUG msg=polling agent=rig-1\n",
+		"err: level=ERROR+4 msg=critical agent=rig-1\n",
+	}, writer.messages)
+
+	// The level set in config is still honoured
+	writer.messages = nil
+	quiet := slog.New(NewSyslogHandler(writer, func(w io.Writer) slog.Handler {
+		return slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelWarn})
+	}))
+	quiet.Info("checked in")
+	quiet.Warn("retrying")
+	assert.Len(t, writer.messages, 1)
+}
+
+func TestNewLogFileWriterJSON(t *testing.T) {
+	a := New(nil)
+	a.LogDirOverride = t.TempDir()
+	a.LogFormat = LogFormatJSON
+	_, err := a.newLogFileWriter()
+	assert.NoError(t, err)
+	contents, err := os.ReadFile(filepath.Join(a.LogDirOverride, "agent.log"))
+	assert.NoError(t, err, "the log file is created")
+	assert.Empty(t, contents, "JSON logs only contain records")
+
+	a.LogDirOverride = t.TempDir()
+	a.LogFormat = LogFormatText
+	_, err = a.newLogFileWriter()
+	assert.NoError(t, err)
+	contents, err = os.ReadFile(filepath.Join(a.LogDirOverride, "agent.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ReSim Agent "+agentVersion+"\n", string(contents))
+}
@@ -1,11 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/http"
 	"os"
@@ -16,16 +14,15 @@ import (
 	"time"
 
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
-	"github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/client"
 	"github.com/google/uuid"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/resim-ai/agent/api"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
 
@@ -39,76 +36,90 @@ const (
 )
 
 type Agent struct {
-	APIClient            *api.ClientWithResponses
-	Docker               DockerClient
-	CurrentToken         *oauth2.Token
-	TokenMutex           sync.Mutex
-	ClientID             string
-	AuthHost             string
-	APIHost              string
-	Name                 string
-	PoolLabels           []string
-	ConfigDirOverride    string
-	LogDirOverride       string
-	LogLevel             string
-	Status               agentStatus
-	AutoUpdate           bool
-	Privileged           bool
-	DockerNetworkMode    DockerNetworkMode
+	APIClient         *api.ClientWithResponses
+	Docker            DockerClient
+	CurrentToken      *oauth2.Token
+	TokenMutex        sync.Mutex
+	ClientID          string
+	AuthHost          string
+	APIHost           string
+	Name              string
+	PoolLabels        []string
+	ConfigDirOverride string
+	LogDirOverride    string
+	LogLevel          string
+	LogFormat         LogFormat
+	LogDestinations   []LogDestination
+	Status            agentStatus
+	AutoUpdate        bool
+	Privileged        bool
+	DockerNetworkMode DockerNetworkMode
+	// The subnet and gateway of the worker network, when the agent creates it
+	DockerNetworkSubnet  string
+	DockerNetworkGateway string
 	HostAWSConfigDir     string
 	HostAWSConfigExists  bool
 	CustomerWorkerConfig CustomWorkerConfig
 	// For testing purposes - allows mocking the AWS config directory lookup
-	getAWSConfigDirFunc    func() (string, bool)
-	ImageMutex             sync.RWMutex
-	WorkerImageURI         string
-	CurrentErrorCount      int
-	MaxErrorCount          int
-	AgentErrorSleep        time.Duration // When the agent encounters an error, it will sleep for this duration before retrying
-	WorkerExitSleep        time.Duration // After the worker exits, the agent will sleep for this duration before launching a new worker
-	OrgName                string
-	currentWorkerID        string
-	ContainerWatchInterval time.Duration // How often to check the status of the container
-	WorkerDir              string        // The directory to store the worker directory
-	RemoveWorkerDir        bool          // Whether to remove the worker directory after the worker exits abnormally
-	RemoveExperienceCache  bool          // Whether to remove the experience cache directory on agent exit
-	ExperienceCacheDir     string        // The directory to store the experience cache
+	getAWSConfigDirFunc         func() (string, bool)
+	Redactor                    *Redactor // Masks secrets in log output and the effective config
+	ImageMutex                  sync.RWMutex
+	WorkerImageURI              string
+	CurrentErrorCount           int
+	MaxErrorCount               int
+	AgentErrorSleep             time.Duration // When the agent encounters an error, it will sleep for this duration before retrying
+	WorkerExitSleep             time.Duration // After the worker exits, the agent will sleep for this duration before launching a new worker
+	OrgName                     string
+	currentWorkerID             string
+	ContainerWatchInterval      time.Duration // How often to check the status of the container
+	WorkerDir                   string        // The directory to store the worker directory
+	RemoveWorkerDir             bool          // Whether to remove the worker directory after the worker exits abnormally
+	RemoveExperienceCache       bool          // Whether to remove the experience cache directory on agent exit
+	ExperienceCacheDir          string        // The directory to store the experience cache
+	HTTPListenAddress           string        // The address for the local HTTP server (e.g. metrics); disabled if empty
+	TracingEndpoint             string        // The OTLP/HTTP endpoint to export traces to; tracing is disabled if empty
+	HealthCheckinTimeout        time.Duration // How long since the last successful checkin before the agent is not ready
+	HealthProgressTimeout       time.Duration // How long the agent loop may make no progress before the agent is unhealthy
+	HealthMinFreeDiskMB         uint64        // The minimum free disk space in the worker and cache directories for the agent to be ready
+	ControlAPI                  bool          // Whether to serve the local control API
+	ControlSocket               string        // The path of the control API socket; defaults to agent.sock in the config directory
+	Containerised               bool          // Whether the agent is running in a container, so paths must be translated to host paths for the worker
+	ContainerID                 string        // The ID or name of the agent's container; defaults to its hostname
+	HostPaths                   *HostPathTranslator
+	RuntimeHost                 string           // The address of the container runtime's API, e.g. unix:///var/run/docker.sock
+	ContainerRuntime            ContainerRuntime // Whether the runtime is Docker or Podman, detected on startup
+	Platform                    v1.Platform      // The platform to pull and run the worker for; detected from the runtime unless configured
+	ImagePullPolicy             ImagePullPolicy  // Whether to pull the worker image, or use one already present locally
+	ImageRetentionCount         int              // How many worker images to keep when removing old ones; 0 disables removing them
+	ImageGCDiskThreshold        int              // The runtime's disk usage percentage over which old worker images are removed after every run
+	RegistryAuthenticator       *RegistryAuthenticator
+	HTTPConfig                  HTTPConfig
+	HTTPClient                  *http.Client  // Makes the agent's outbound HTTP(S) requests, configured by HTTPConfig
+	PreTaskHooks                []TaskHook    // Run before each worker; the worker isn't run if one fails
+	PostTaskHooks               []TaskHook    // Run after each worker exits
+	HookTimeout                 time.Duration // How long a hook may run for, unless it sets its own timeout
+	PreTaskHookFailureUnhealthy bool          // Whether a failed pre-task hook marks the rig unhealthy
+	HealthProbes                []HealthProbe // Checks of the rig's hardware; the agent takes no work while one fails
+	HealthProbeInterval         time.Duration
+	HealthProbeTimeout          time.Duration // How long a probe may take, unless it sets its own timeout
+	HostFactPoolLabels          bool          // Whether to advertise pool labels for the host's architecture, CPUs, memory and kernel
+	DevicePoolLabels            []DevicePoolLabel
+	PoolLabelScripts            []PoolLabelScript
+	PoolLabelScriptTimeout      time.Duration // How long a pool label script may run for, unless it sets its own timeout
+	PoolLabelsRefreshInterval   time.Duration // How often the dynamic pool labels are re-evaluated
+	WorkerMaxRuntime            time.Duration // How long the worker may run before it is stopped; 0 for no limit
+	WorkerStopGracePeriod       time.Duration // How long a timed out worker has to exit after SIGTERM before it is killed
+	probeMutex                  sync.Mutex    // Serialises evaluations of the health probes, which may share hardware
+	stateMutex                  sync.RWMutex
+	state                       agentState
 }
 
 func main() {
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv)
+	err := newRootCommand().Execute()
 	if err != nil {
-		slog.Error("error initializing Docker client", "err", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	defer dockerClient.Close()
-
-	a := New(dockerClient)
-
-	ConfigDir := os.Getenv("RESIM_AGENT_CONFIG_DIR")
-	if ConfigDir != "" {
-		a.ConfigDirOverride = ConfigDir
-	}
-
-	LogDir := os.Getenv("RESIM_AGENT_LOG_DIR")
-	if LogDir != "" {
-		a.LogDirOverride = LogDir
-	}
-
-	err = a.LoadConfig()
-	if err != nil {
-		slog.Error("error loading config", "err", err)
-	}
-
-	err = a.Start()
-	if a.RemoveExperienceCache {
-		a.DeleteExperienceCache()
-	}
-	if err != nil {
-		os.Exit(1)
-	} else {
-		os.Exit(0)
-	}
 }
 
 func New(dockerClient DockerClient) *Agent {
@@ -116,10 +127,18 @@ func New(dockerClient DockerClient) *Agent {
 		Docker:                 dockerClient,
 		ContainerWatchInterval: 2 * time.Second,
 		WorkerDir:              TmpResim,
+		Redactor:               NewRedactor(DefaultRedactPatterns),
+		HealthCheckinTimeout:   HealthCheckinTimeoutDefault,
+		HealthProgressTimeout:  HealthProgressTimeoutDefault,
+		HealthMinFreeDiskMB:    HealthMinFreeDiskMBDefault,
+		RuntimeHost:            runtimeHostFromSocket(DockerSocketPath),
+		ImagePullPolicy:        ImagePullPolicyAlways,
+		HTTPClient:             http.DefaultClient,
 	}
 }
 
 func (a *Agent) Start() error {
+	a.recordStart()
 	a.getOrgName()
 
 	err := a.InitializeLogging()
@@ -134,7 +153,19 @@ func (a *Agent) Start() error {
 		return err
 	}
 
-	ctx := context.Background()
+	// Cancelled when the agent exits, stopping its background refreshes
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shutdownTracing, err := a.initTracing(ctx)
+	if err != nil {
+		slog.Error("error initializing tracing", "err", err)
+		return err
+	}
+	defer shutdownTracing(ctx)
+
+	// The platform is reported to the API, so find it first
+	a.detectContainerRuntime(ctx)
+
 	apiClient, err := a.getAPIClient(ctx)
 	if err != nil {
 		slog.Error("error setting API client", "err", err)
@@ -144,7 +175,21 @@ func (a *Agent) Start() error {
 
 	slog.Info("agent initialised", "version", agentVersion, "log_level", a.LogLevel)
 
+	err = a.startHTTPServer()
+	if err != nil {
+		slog.Error("error starting agent HTTP server", "err", err)
+		return err
+	}
+
+	err = a.startControlServer()
+	if err != nil {
+		slog.Error("error starting control API", "err", err)
+		return err
+	}
+
+	a.startPoolLabelRefresh(ctx)
 	a.startHeartbeat()
+	a.startHealthProbes(ctx)
 
 	err = CreateDir(a.WorkerDir)
 	if err != nil {
@@ -158,9 +203,57 @@ func (a *Agent) Start() error {
 		slog.Error("Error creating experience cache directory", "err", err, "path", a.ExperienceCacheDir)
 		return err
 	}
+	experienceCacheBytes.Set(float64(dirSize(a.ExperienceCacheDir)))
+	maxErrorCount.Set(float64(a.MaxErrorCount))
+
+	if a.Containerised {
+		err = a.discoverHostPaths(ctx)
+		if err != nil {
+			slog.Error("Error finding host paths for the agent's container", "err", err)
+			return err
+		}
+	}
+
+	err = a.ensureWorkerNetwork(ctx)
+	if err != nil {
+		slog.Error("Error setting up the worker network", "err", err)
+		return err
+	}
+	a.checkRuntimeDiskUsage(ctx)
+
+	a.startSystemdNotify()
 
-	var lastPulledImage string
+	// Workers outlive the agent if it is killed, so pick up where it left off
+	err = a.recoverWorkers(ctx)
+	if err != nil {
+		slog.Warn("Error recovering workers from a previous run", "err", err)
+	}
+
+	a.logAPIStatus(a.probeAPI(ctx))
+
+	var lastPulledImage pulledImage
+	// The image the worker last ran successfully from, to remove old images when it changes
+	var lastRunImage pulledImage
+	// The number of consecutive iterations the API has been unavailable, which are
+	// not counted against MaxErrorCount
+	var apiUnavailableCount int
+	// Each iteration of the loop is a trace; its span is ended when the next iteration begins
+	var iterationSpan trace.Span
+	defer func() {
+		if iterationSpan != nil {
+			endSpan(iterationSpan, err)
+		}
+	}()
 	for {
+		if iterationSpan != nil {
+			endSpan(iterationSpan, err)
+		}
+		var iterationCtx context.Context
+		iterationCtx, iterationSpan = startSpan(ctx, "agent.iteration")
+		a.recordProgress()
+
+		errorCount.Set(float64(a.CurrentErrorCount))
+		a.recordErrorCount(a.CurrentErrorCount)
 		if a.CurrentErrorCount > a.MaxErrorCount {
 			slog.Error("Agent has failed too many times in a row, exiting")
 			if a.RemoveWorkerDir {
@@ -169,11 +262,43 @@ func (a *Agent) Start() error {
 			return err
 		}
 
+		a.waitWhilePaused()
+		if a.isDraining() {
+			slog.Info("Agent drained, exiting")
+			return nil
+		}
+
+		// After a failure, wait for the API to recover before checking in again
+		if a.CurrentErrorCount > 0 || apiUnavailableCount > 0 {
+			apiStatus, detail := a.probeAPI(iterationCtx)
+			if apiStatus == APIStatusUnavailable {
+				a.logAPIStatus(apiStatus, detail)
+				time.Sleep(a.apiUnavailableSleep(apiUnavailableCount))
+				apiUnavailableCount++
+				continue
+			}
+			apiUnavailableCount = 0
+		}
+
+		// Heartbeats advertise the last results, but work is only taken on fresh ones
+		if !allHealthy(a.refreshProbes(iterationCtx)) {
+			// Don't check in to take work; wait for the probes to recover
+			slog.Info("Health probes are failing, not taking work", "probes", probesHealth(a.getState()).Detail)
+			time.Sleep(a.HealthProbeInterval)
+			continue
+		}
 		var startup api.AgentCheckinOutput
-		startup, err = a.checkin()
+		startup, err = a.checkin(iterationCtx)
 		slog.Info("Received startup response from AgentAPI")
 		if err != nil {
 			slog.Error("Error checking in", "err", err)
+			apiStatus, detail := a.probeAPI(iterationCtx)
+			a.logAPIStatus(apiStatus, detail)
+			if apiStatus == APIStatusUnavailable {
+				time.Sleep(a.apiUnavailableSleep(apiUnavailableCount))
+				apiUnavailableCount++
+				continue
+			}
 			err = errors.Wrap(err, fmt.Sprintf("error checking in (attempt %d)", a.CurrentErrorCount))
 			a.CurrentErrorCount++
 			time.Sleep(a.AgentErrorSleep)
@@ -205,8 +330,10 @@ func (a *Agent) Start() error {
 			workerEnvVars = append(workerEnvVars, fmt.Sprintf("%s=%s", envVar[0], envVar[1]))
 		}
 		// Attempt to pull the worker image
-		lastPulledImage, err = a.maybePullImage(ctx, lastPulledImage)
+		a.setWorkerState(WorkerStatePulling)
+		lastPulledImage, err = a.maybePullImage(iterationCtx, lastPulledImage)
 		if err != nil {
+			a.setWorkerState(WorkerStateIdle)
 			slog.Error("Error pulling image", "err", err)
 			err = errors.Wrap(err, fmt.Sprintf("error pulling image (attempt %d)", a.CurrentErrorCount))
 			a.CurrentErrorCount++
@@ -215,20 +342,34 @@ func (a *Agent) Start() error {
 		}
 
 		// Attempt to run the worker; if this fails, we need to error the task.
-		err = a.runWorker(ctx, lastPulledImage, workerEnvVars)
-		if err != nil {
+		a.setWorkerImage(lastPulledImage.Ref())
+		err = a.runWorker(iterationCtx, lastPulledImage.Ref(), workerEnvVars)
+		a.setWorkerState(WorkerStateIdle)
+		a.reportWorkerOutcome(iterationCtx, err)
+		if workerErrorCounts(err) {
 			slog.Error("Error running ReSim worker", "err", err)
 			err = errors.Wrap(err, fmt.Sprintf("error running ReSim worker (attempt %d)", a.CurrentErrorCount))
 			a.CurrentErrorCount++
 			time.Sleep(a.AgentErrorSleep)
 			continue
 		}
+		// Workers that failed, e.g. were OOM killed, still ran: the agent is healthy
+		err = nil
 
 		a.CurrentErrorCount = 0
+		errorCount.Set(0)
+		a.recordErrorCount(0)
+		a.collectWorkerImages(iterationCtx, lastPulledImage, lastPulledImage != lastRunImage)
+		lastRunImage = lastPulledImage
+		experienceCacheBytes.Set(float64(dirSize(a.ExperienceCacheDir)))
 		if viper.GetBool(OneTaskKey) {
 			slog.Info("Agent launched in one-task mode, exiting")
 			return nil
 		}
+		if a.isDraining() {
+			slog.Info("Agent drained, exiting")
+			return nil
+		}
 		time.Sleep(a.AgentErrorSleep)
 	}
 }
@@ -261,28 +402,61 @@ func (a *Agent) getOrgName() error {
 // The target image URI is recorded on the agent struct already.
 // The URI passed in is the previous URI pulled. If the target image is different, it will be pulled.
 // The return value is the last URI pulled - updated if the image was pulled.
-func (a *Agent) maybePullImage(ctx context.Context, oldImage string) (string, error) {
+func (a *Agent) maybePullImage(ctx context.Context, last pulledImage) (_ pulledImage, err error) {
+	ctx, span := startSpan(ctx, "agent.image_pull")
+	defer func() { endSpan(span, err) }()
+
 	a.ImageMutex.RLock()
 	defer a.ImageMutex.RUnlock()
-	if a.WorkerImageURI == oldImage {
-		slog.Info("Image already pulled", "image", oldImage)
-		return oldImage, nil
+	if a.WorkerImageURI == last.URI {
+		// A tag can be moved to a new image, so check whether it has been
+		if a.ImagePullPolicy != ImagePullPolicyAlways || last.Digest == "" || isDigestPinned(last.URI) {
+			slog.Info("Image already pulled", "image", last.URI)
+			return last, nil
+		}
+		remoteDigest, err := a.remoteImageDigest(ctx, last.URI)
+		if err != nil {
+			slog.Warn("Error checking the registry for a new worker image, using the last pulled", "image", last.URI, "digest", last.Digest, "err", err)
+			return last, nil
+		}
+		if remoteDigest == last.Digest {
+			slog.Info("Image already pulled", "image", last.URI, "digest", last.Digest)
+			return last, nil
+		}
+		slog.Info("Worker image tag has moved", "image", last.URI, "old_digest", last.Digest, "new_digest", remoteDigest)
 	}
 
-	slog.Info("Pulling image", "image", a.WorkerImageURI)
-	r, err := a.Docker.ImagePull(ctx, a.WorkerImageURI, image.PullOptions{
-		Platform: "linux/amd64",
-	})
-	if err != nil {
-		return oldImage, err
+	if a.ImagePullPolicy != ImagePullPolicyAlways {
+		local, found, err := a.localImage(ctx, a.WorkerImageURI)
+		if err != nil {
+			return last, err
+		}
+		if found {
+			slog.Info("Using local image", "image", local.URI, "digest", local.Digest, "pull_policy", a.ImagePullPolicy)
+			return local, nil
+		}
+		if a.ImagePullPolicy == ImagePullPolicyNever {
+			return last, a.missingImageError(ctx, a.WorkerImageURI)
+		}
 	}
 
-	var buffer bytes.Buffer
-	io.Copy(&buffer, r)
-	r.Close()
-	slog.Info("Pulled image", "image", a.WorkerImageURI)
+	platform := formatPlatform(a.Platform)
+	slog.Info("Pulling image", "image", a.WorkerImageURI, "platform", platform)
+	span.SetAttributes(attribute.String("image", a.WorkerImageURI), attribute.String("platform", platform))
+	pullStart := time.Now()
+	progress, err := a.pullImage(ctx, a.WorkerImageURI)
+	if err != nil {
+		return last, err
+	}
+	imagePullDuration.Observe(time.Since(pullStart).Seconds())
+	imagePullBytes.Add(float64(progress.Bytes))
+	if progress.Digest == "" {
+		slog.Warn("Container runtime did not report the pulled image's digest, so the worker will run by tag", "image", a.WorkerImageURI)
+	}
+	slog.Info("Pulled image", "image", a.WorkerImageURI, "bytes", progress.Bytes, "digest", progress.Digest)
+	span.SetAttributes(attribute.String("image.digest", progress.Digest))
 
-	return a.WorkerImageURI, nil
+	return pulledImage{URI: a.WorkerImageURI, Digest: progress.Digest}, nil
 }
 
 func (a *Agent) GetConfigDir() (string, error) {
@@ -303,23 +477,28 @@ func (a *Agent) GetConfigDir() (string, error) {
 	return expectedDir, nil
 }
 
-func (a *Agent) checkin() (api.AgentCheckinOutput, error) {
-	ctx := context.Background()
+func (a *Agent) checkin(ctx context.Context) (_ api.AgentCheckinOutput, err error) {
+	ctx, span := startSpan(ctx, "agent.checkin")
+	defer func() { endSpan(span, err) }()
 
 	pollResponse, err := a.APIClient.AgentCheckinWithResponse(ctx, api.AgentCheckinInput{
 		AgentID:      &a.Name,
 		AgentVersion: Ptr(agentVersion),
-		PoolLabels:   &a.PoolLabels,
+		PoolLabels:   Ptr(a.advertisedPoolLabels()),
 	})
 	if err != nil {
 		slog.Error("Error checking in", "err", err)
+		checkinsTotal.WithLabelValues("failure").Inc()
 		return api.AgentCheckinOutput{}, err
 	}
 
 	if pollResponse.StatusCode() != 200 {
 		slog.Error("error polling for task", "err", pollResponse.StatusCode())
+		checkinsTotal.WithLabelValues("failure").Inc()
 		return api.AgentCheckinOutput{}, errors.New("error polling for task")
 	}
+	checkinsTotal.WithLabelValues("success").Inc()
+	a.recordCheckin()
 
 	a.ImageMutex.Lock()
 	defer a.ImageMutex.Unlock()
@@ -330,6 +509,16 @@ func (a *Agent) checkin() (api.AgentCheckinOutput, error) {
 	return *pollResponse.JSON200, nil
 }
 
+// advertisedPoolLabels returns the pool labels to check in with: the configured
+// and dynamic pool labels. If a health probe was failing when they were last
+// evaluated, none are advertised, so that no work is routed to the rig.
+func (a *Agent) advertisedPoolLabels() []string {
+	if !a.probesHealthy() {
+		return []string{}
+	}
+	return a.poolLabels()
+}
+
 func StringifyEnvironmentVariables(inputVars [][]string) []string {
 	var envVars []string
 	for _, v := range inputVars {
@@ -343,8 +532,22 @@ func (a *Agent) getWorkerID() string {
 	return fmt.Sprintf("agent-%s|%s|%s", a.OrgName, a.Name, a.currentWorkerID)
 }
 
-func (a *Agent) runWorker(ctx context.Context, imageURI string, workerEnvVars []string) error {
+func (a *Agent) runWorker(ctx context.Context, imageURI string, workerEnvVars []string) (err error) {
 	a.currentWorkerID = uuid.New().String() // assign a new workerID for tracking purposes every time
+	ctx, span := startSpan(ctx, "agent.worker", trace.WithAttributes(
+		attribute.String("worker.id", a.getWorkerID()),
+		attribute.String("image", imageURI),
+	))
+	defer func() { endSpan(span, err) }()
+
+	err = a.runPreTaskHooks(ctx, imageURI)
+	if err != nil {
+		return err
+	}
+	// The worker's start time, if it started, for the post-task hooks
+	var workerStart time.Time
+	defer func() { a.runPostTaskHooks(ctx, imageURI, err, workerStart) }()
+
 	providedEnvVars := []string{
 		"RERUN_WORKER_ENVIRONMENT=dev",
 		"RERUN_WORKER_REUSABLE=true",
@@ -355,123 +558,222 @@ func (a *Agent) runWorker(ctx context.Context, imageURI string, workerEnvVars []
 		providedEnvVars = append(providedEnvVars, "RERUN_WORKER_PRIVILEGED=true")
 	}
 	providedEnvVars = append(providedEnvVars, workerEnvVars...)
-	providedEnvVars = append(providedEnvVars, fmt.Sprintf("RERUN_WORKER_POOL_LABELS=%v", strings.Join(a.PoolLabels, ",")))
+	providedEnvVars = append(providedEnvVars, fmt.Sprintf("RERUN_WORKER_POOL_LABELS=%v", strings.Join(a.poolLabels(), ",")))
+	customWorkerConfig := a.CustomerWorkerConfig
+	// The worker mounts the cache into customer containers, so it needs the host path
+	customWorkerConfig.CacheDir, err = a.hostPath(customWorkerConfig.CacheDir)
+	if err != nil {
+		return err
+	}
 	// convert the custom worker config to json string:
-	customWorkerConfigJSON, err := json.Marshal(a.CustomerWorkerConfig)
+	customWorkerConfigJSON, err := json.Marshal(customWorkerConfig)
 	if err != nil {
 		slog.Error("Error marshalling custom worker config", "err", err)
 		return err
 	}
-	slog.Info("Custom worker config", "config", string(customWorkerConfigJSON))
+	slog.Info("Custom worker config", "config", a.Redactor.RedactCustomWorkerConfig(customWorkerConfig))
 	providedEnvVars = append(providedEnvVars, "RERUN_WORKER_CUSTOM_WORKER_CONFIG="+string(customWorkerConfigJSON))
 	providedEnvVars = append(providedEnvVars, "RERUN_WORKER_WORKER_TYPE=agent")
-
-	var homeDir string
-	user, err := user.Current()
-	if err != nil {
-		slog.Warn("Couldn't lookup user; assuming root", "error", err)
-		homeDir = "/root"
-	} else {
-		homeDir = user.HomeDir
-	}
-
-	hostDockerConfigDir, _ := filepath.Abs(filepath.Join(homeDir, ".docker"))
-	_, err = os.Stat(hostDockerConfigDir)
-	if err != nil {
-		slog.Info("Docker config directory does not exist")
+	providedEnvVars = append(providedEnvVars, traceContextEnvVars(ctx)...)
+	providedEnvVars = append(providedEnvVars, a.HTTPConfig.workerEnvVars()...)
+	if _, isUnix := a.runtimeSocketPath(); !isUnix {
+		// The runtime's socket can't be mounted, so the worker must connect to it in the same way as the agent
+		providedEnvVars = append(providedEnvVars, "DOCKER_HOST="+a.RuntimeHost)
 	}
 
 	config := &container.Config{
-		Image: imageURI,
-		Env:   providedEnvVars,
+		Image:  imageURI,
+		Env:    providedEnvVars,
+		Labels: a.workerLabels(),
 	}
 
+	mounts, err := a.workerMounts()
+	if err != nil {
+		return err
+	}
 	hostConfig := &container.HostConfig{
-		Mounts: []mount.Mount{
-			{
-				Type:   mount.TypeBind,
-				Source: "/var/run/docker.sock",
-				Target: "/var/run/docker.sock",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: "/tmp/resim",
-				Target: "/tmp/resim",
-			},
-			{
-				Type:   mount.TypeBind,
-				Source: hostDockerConfigDir,
-				Target: "/root/.docker",
-			},
-		},
+		Mounts: mounts,
 	}
-
-	if a.HostAWSConfigExists {
-		hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
-			Type:   mount.TypeBind,
-			Source: a.HostAWSConfigDir,
-			Target: "/root/.aws",
-		})
+	if a.ContainerRuntime == ContainerRuntimePodman {
+		// Under SELinux, Podman labels containers so that they can't use its socket
+		hostConfig.SecurityOpt = []string{"label=disable"}
 	}
 
-	// Mount the experience cache directory
-	hostConfig.Mounts = append(hostConfig.Mounts, mount.Mount{
-		Type:   mount.TypeBind,
-		Source: a.ExperienceCacheDir,
-		Target: "/tmp/resim/cache",
-	})
+	networkingConfig := a.workerNetworking(hostConfig)
 
+	createCtx, createSpan := startSpan(ctx, "worker.create")
 	res, err := a.Docker.ContainerCreate(
-		context.TODO(),
+		createCtx,
 		config,
 		hostConfig,
-		&network.NetworkingConfig{},
-		&v1.Platform{},
+		networkingConfig,
+		&a.Platform,
 		fmt.Sprintf("worker-%s", a.currentWorkerID),
 	)
+	endSpan(createSpan, err)
 	if err != nil {
 		// Try to remove container and volumes if there is an error:
 		a.removeContainer(ctx, res.ID)
-		return errors.Wrap(err, "error creating container for worker")
+		err = wrapPlatformError(err, imageURI, a.Platform)
+		outcome := classifyCreateError(err)
+		a.recordWorkerOutcome(outcome, 0, err.Error(), 0)
+		return &WorkerRunError{Outcome: outcome, Err: errors.Wrap(err, "error creating container for worker")}
 	}
 
-	err = a.Docker.ContainerStart(ctx, res.ID, container.StartOptions{})
+	containerStartCtx, containerStartSpan := startSpan(ctx, "worker.start")
+	err = a.Docker.ContainerStart(containerStartCtx, res.ID, container.StartOptions{})
+	endSpan(containerStartSpan, err)
 	if err != nil {
 		// Try to remove container and volumes if there is an error:
 		a.removeContainer(ctx, res.ID)
-		return errors.Wrap(err, "error starting container for worker")
+		a.recordWorkerOutcome(WorkerOutcomeStartFailed, 0, err.Error(), 0)
+		return &WorkerRunError{Outcome: WorkerOutcomeStartFailed, Err: errors.Wrap(err, "error starting container for worker")}
 	}
 	slog.Info("Container for worker starting", "worker", a.currentWorkerID)
+	workerStart = time.Now()
+	a.workerStarted(res.ID)
+	err = a.watchWorker(ctx, res.ID, workerStart)
+
+	// Remove container and volumes:
+	a.removeContainer(ctx, res.ID)
+
+	return err
+}
+
+// watchWorker waits for the worker's container to exit, recording its outcome.
+// It returns a WorkerRunError if the worker didn't succeed.
+func (a *Agent) watchWorker(ctx context.Context, containerID string, workerStart time.Time) error {
+	watchCtx, watchSpan := startSpan(ctx, "worker.watch")
+	// The Agent API only gives tasks' container timeouts to the worker, which polls
+	// for the tasks, so WorkerMaxRuntime is the only limit the agent enforces
+	timeout := a.WorkerMaxRuntime
+	timedOut := false
 	// From now one, the worker is responsible for updating its own status.
 	for {
-		status, err := a.Docker.ContainerInspect(ctx, res.ID)
+		a.recordProgress()
+		status, err := a.Docker.ContainerInspect(watchCtx, containerID)
 		if err != nil {
-			return errors.Wrap(err, "error inspecting container for worker")
+			endSpan(watchSpan, err)
+			a.recordWorkerOutcome(WorkerOutcomeDaemonError, 0, err.Error(), 0)
+			return &WorkerRunError{Outcome: WorkerOutcomeDaemonError, Err: errors.Wrap(err, "error inspecting container for worker")}
 		}
 		if status.State.Status != "running" {
-			if status.State.ExitCode == 0 {
-				slog.Info("Worker succeeded")
-			} else {
-				slog.Info("Worker container exited non-zero", "exit_code", status.State.ExitCode, "err", status.State.Error)
+			outcome := classifyExit(status.State, a.isWorkerCancelled(), timedOut)
+			a.recordWorkerOutcome(outcome, status.State.ExitCode, status.State.Error, time.Since(workerStart))
+			watchSpan.SetAttributes(
+				attribute.String("worker.outcome", string(outcome)),
+				attribute.Int("worker.exit_code", status.State.ExitCode),
+				attribute.Bool("worker.oom_killed", status.State.OOMKilled),
+			)
+			if outcome != WorkerOutcomeSucceeded {
+				runErr := &WorkerRunError{Outcome: outcome, ExitCode: status.State.ExitCode}
+				if timedOut {
+					runErr.Err = &WorkerTimeoutError{Timeout: timeout}
+				} else if status.State.Error != "" {
+					runErr.Err = errors.New(status.State.Error)
+				}
+				err = runErr
 			}
+			endSpan(watchSpan, err)
 			time.Sleep(a.WorkerExitSleep)
-			break
-		} else {
-			slog.Info("Worker is running")
+			return err
+		}
+		if timeout > 0 && time.Since(workerStart) > timeout {
+			if !timedOut {
+				slog.Error("Worker has run for longer than its timeout, stopping it", "worker", a.currentWorkerID, "timeout", timeout, "grace_period", a.WorkerStopGracePeriod)
+				timedOut = true
+			}
+			// Until the worker has exited, keep trying to stop it
+			a.stopTimedOutWorker(watchCtx, containerID)
+			time.Sleep(a.ContainerWatchInterval)
+			continue
 		}
+		slog.Info("Worker is running")
 		time.Sleep(a.ContainerWatchInterval)
 	}
+}
 
-	// Remove container and volumes:
-	a.removeContainer(ctx, res.ID)
+// workerMounts returns the bind mounts for the worker: the Docker socket, the
+// worker and experience cache directories, and Docker and AWS config. When the
+// agent is containerised, their sources are translated to host paths.
+func (a *Agent) workerMounts() ([]mount.Mount, error) {
+	hostDockerConfigDir := dockerConfigDir()
+	_, err := os.Stat(hostDockerConfigDir)
+	if err != nil {
+		slog.Info("Docker config directory does not exist")
+	}
 
-	return nil
+	type workerMount struct {
+		mount.Mount
+		required bool
+	}
+	var workerMounts []workerMount
+	// The worker always finds the runtime's socket in the default location
+	if socketPath, isUnix := a.runtimeSocketPath(); isUnix {
+		workerMounts = append(workerMounts, workerMount{
+			Mount:    mount.Mount{Type: mount.TypeBind, Source: socketPath, Target: DockerSocketPath},
+			required: true,
+		})
+	}
+	workerMounts = append(workerMounts,
+		workerMount{Mount: mount.Mount{Type: mount.TypeBind, Source: a.WorkerDir, Target: TmpResim}, required: true},
+		workerMount{Mount: mount.Mount{Type: mount.TypeBind, Source: hostDockerConfigDir, Target: "/root/.docker"}},
+	)
+	if a.HostAWSConfigExists {
+		workerMounts = append(workerMounts, workerMount{
+			Mount: mount.Mount{Type: mount.TypeBind, Source: a.HostAWSConfigDir, Target: "/root/.aws"},
+		})
+	}
+	caMount, ok, err := a.HTTPConfig.workerCAMount(a.WorkerDir)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		workerMounts = append(workerMounts, workerMount{Mount: caMount, required: true})
+	}
+	// Mount the experience cache directory
+	workerMounts = append(workerMounts, workerMount{
+		Mount:    mount.Mount{Type: mount.TypeBind, Source: a.ExperienceCacheDir, Target: "/tmp/resim/cache"},
+		required: true,
+	})
+
+	var mounts []mount.Mount
+	for _, m := range workerMounts {
+		source, err := a.hostPath(m.Source)
+		if err != nil && m.required {
+			return nil, err
+		}
+		if err != nil {
+			slog.Warn("Not mounting directory into worker", "path", m.Source, "err", err)
+			continue
+		}
+		m.Source = source
+		mounts = append(mounts, m.Mount)
+	}
+	return mounts, nil
+}
+
+// dockerConfigDir is the Docker config directory of the agent's user, which is
+// mounted into the worker.
+func dockerConfigDir() string {
+	var homeDir string
+	user, err := user.Current()
+	if err != nil {
+		slog.Warn("Couldn't lookup user; assuming root", "error", err)
+		homeDir = "/root"
+	} else {
+		homeDir = user.HomeDir
+	}
+	dir, _ := filepath.Abs(filepath.Join(homeDir, ".docker"))
+	return dir
 }
 
 func (a *Agent) removeContainer(ctx context.Context, containerID string) {
+	ctx, span := startSpan(ctx, "worker.remove")
 	err := a.Docker.ContainerRemove(ctx, containerID, container.RemoveOptions{
 		RemoveVolumes: true,
 	})
+	endSpan(span, err)
 	if err != nil {
 		slog.WarnContext(ctx, "error removing container", "error", err)
 	}
@@ -486,7 +788,11 @@ func (a *Agent) startHeartbeat() error {
 
 	go func() {
 		for range ticker.C {
-			a.checkin()
+			heartbeatStart := time.Now()
+			ctx, span := startSpan(context.Background(), "agent.heartbeat")
+			_, err := a.checkin(ctx)
+			endSpan(span, err)
+			heartbeatDuration.Observe(time.Since(heartbeatStart).Seconds())
 		}
 	}()
 
@@ -528,11 +834,15 @@ func (a *Agent) DeleteExperienceCache() {
 }
 
 func (a *Agent) getAPIClient(ctx context.Context) (*api.ClientWithResponses, error) {
+	// The OAuth client wraps the agent's client, so requests to the API go through its proxy
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, a.HTTPClient)
 	oauthClient := oauth2.NewClient(ctx, a)
 	APIClient, err := api.NewClientWithResponses(
 		a.APIHost,
 		api.WithHTTPClient(oauthClient),
 		api.WithRequestEditorFn(AddAgentIDEditor(a.Name, agentVersion)),
+		api.WithRequestEditorFn(AddAgentPlatformEditor(a.Platform)),
+		api.WithRequestEditorFn(AddTraceContextEditor()),
 	)
 	if err != nil {
 		return &api.ClientWithResponses{}, err
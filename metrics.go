@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "resim_agent"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	metricsFactory  = promauto.With(metricsRegistry)
+
+	buildInfo = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Always 1; labelled with the agent version and the Go version it was built with.",
+	}, []string{"version", "goversion"})
+	checkinsTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "checkins_total",
+		Help:      "Checkins with the Agent API, by result.",
+	}, []string{"result"})
+	apiProbesTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_probes_total",
+		Help:      "Probes of the Agent API's health and ping endpoints, by resulting API status.",
+	}, []string{"status"})
+	heartbeatDuration = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "heartbeat_duration_seconds",
+		Help:      "Latency of heartbeat checkins with the Agent API.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	imagePullDuration = metricsFactory.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_pull_duration_seconds",
+		Help:      "Time taken to pull the worker image.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	imagePullBytes = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_pull_bytes_total",
+		Help:      "Compressed layer bytes downloaded while pulling worker images.",
+	})
+	workerImagesRemovedTotal = metricsFactory.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "worker_images_removed_total",
+		Help:      "Old worker images removed to free disk space.",
+	})
+	workerRunsTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "worker_runs_total",
+		Help:      "Worker runs, by outcome.",
+	}, []string{"outcome"})
+	workerDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "worker_duration_seconds",
+		Help:      "Time from worker container start to exit, by outcome.",
+		Buckets:   prometheus.ExponentialBuckets(30, 2, 12),
+	}, []string{"outcome"})
+	workerOutcomeReportsTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "worker_outcome_reports_total",
+		Help:      "Reports to the Agent API of worker runs that didn't succeed, by result.",
+	}, []string{"result"})
+	taskHookRunsTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "task_hook_runs_total",
+		Help:      "Pre-task and post-task hook runs, by kind and result.",
+	}, []string{"kind", "result"})
+	healthProbeUp = metricsFactory.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "health_probe_up",
+		Help:      "1 if the health probe passed when last evaluated, otherwise 0.",
+	}, []string{"probe"})
+	errorCount = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "error_count",
+		Help:      "Current number of consecutive errors in the agent loop.",
+	})
+	maxErrorCount = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "max_error_count",
+		Help:      "Number of consecutive errors after which the agent exits.",
+	})
+	tokenRefreshesTotal = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_refreshes_total",
+		Help:      "Authentications with the auth server, by mode.",
+	}, []string{"mode"})
+	experienceCacheBytes = metricsFactory.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "experience_cache_bytes",
+		Help:      "Size of the experience cache directory, updated after each worker run.",
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	buildInfo.WithLabelValues(agentVersion, runtime.Version()).Set(1)
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	a := New(nil)
+	checkinsTotal.WithLabelValues("success").Inc()
+
+	recorder := httptest.NewRecorder()
+	a.newHTTPHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	body := recorder.Body.String()
+	assert.Contains(t, body, `resim_agent_build_info{goversion=`)
+	assert.Contains(t, body, `version="`+agentVersion+`"`)
+	assert.Contains(t, body, `resim_agent_checkins_total{result="success"}`)
+	assert.Contains(t, body, "resim_agent_max_error_count")
+}
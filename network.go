@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+)
+
+// networkNamePattern matches the names Docker allows for user-defined networks
+var networkNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// isCustom reports whether the mode is a user-defined network, rather than the
+// bridge or host network.
+func (m DockerNetworkMode) isCustom() bool {
+	return m != DockerNetworkModeBridge && m != DockerNetworkModeHost
+}
+
+// parseDNSServers checks that DNS servers are IP addresses.
+func parseDNSServers(servers []string) ([]string, error) {
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			return nil, fmt.Errorf("DNS server %q is not an IP address", server)
+		}
+	}
+	return servers, nil
+}
+
+// parseExtraHosts checks that extra hosts are in Docker's host:ip form. The IP
+// may be host-gateway, for the host's address.
+func parseExtraHosts(hosts []string) ([]string, error) {
+	for _, host := range hosts {
+		name, ip, found := strings.Cut(host, ":")
+		if !found || name == "" || (ip != "host-gateway" && net.ParseIP(ip) == nil) {
+			return nil, fmt.Errorf("extra host %q is not in the form host:ip", host)
+		}
+	}
+	return hosts, nil
+}
+
+// validateNetworkSubnet checks the subnet and gateway for a user-defined network
+// created by the agent.
+func validateNetworkSubnet(subnet string, gateway string) error {
+	if subnet == "" {
+		if gateway != "" {
+			return fmt.Errorf("a gateway requires a subnet")
+		}
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %w", subnet, err)
+	}
+	if gateway == "" {
+		return nil
+	}
+	gatewayIP := net.ParseIP(gateway)
+	if gatewayIP == nil || !ipNet.Contains(gatewayIP) {
+		return fmt.Errorf("gateway %q is not an IP address in %v", gateway, subnet)
+	}
+	return nil
+}
+
+// ensureWorkerNetwork creates the user-defined network the worker runs on, if
+// it doesn't exist. Existing networks are used as they are.
+func (a *Agent) ensureWorkerNetwork(ctx context.Context) error {
+	if !a.DockerNetworkMode.isCustom() {
+		return nil
+	}
+	name := string(a.DockerNetworkMode)
+	existing, err := a.Docker.NetworkInspect(ctx, name, network.InspectOptions{})
+	if err == nil {
+		slog.Info("Using existing worker network", "network", name, "driver", existing.Driver)
+		return nil
+	}
+	if !errdefs.IsNotFound(err) {
+		return fmt.Errorf("error inspecting worker network %v: %w", name, err)
+	}
+
+	options := network.CreateOptions{
+		Driver: "bridge",
+		Labels: map[string]string{
+			WorkerLabelAgentName: a.Name,
+			WorkerLabelOrg:       a.OrgName,
+		},
+	}
+	if a.DockerNetworkSubnet != "" {
+		options.IPAM = &network.IPAM{
+			Config: []network.IPAMConfig{{Subnet: a.DockerNetworkSubnet, Gateway: a.DockerNetworkGateway}},
+		}
+	}
+	slog.Info("Creating worker network", "network", name, "subnet", a.DockerNetworkSubnet, "gateway", a.DockerNetworkGateway)
+	_, err = a.Docker.NetworkCreate(ctx, name, options)
+	if err != nil && !errdefs.IsConflict(err) {
+		return fmt.Errorf("error creating worker network %v: %w", name, err)
+	}
+	return nil
+}
+
+// workerNetworking applies the worker network, DNS and extra hosts to the
+// worker's container.
+func (a *Agent) workerNetworking(hostConfig *container.HostConfig) *network.NetworkingConfig {
+	hostConfig.DNS = a.CustomerWorkerConfig.DNS
+	hostConfig.DNSSearch = a.CustomerWorkerConfig.DNSSearch
+	hostConfig.ExtraHosts = a.CustomerWorkerConfig.ExtraHosts
+	networkingConfig := &network.NetworkingConfig{}
+	if a.DockerNetworkMode.isCustom() {
+		name := string(a.DockerNetworkMode)
+		hostConfig.NetworkMode = container.NetworkMode(name)
+		networkingConfig.EndpointsConfig = map[string]*network.EndpointSettings{name: {}}
+	}
+	return networkingConfig
+}
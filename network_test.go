@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseExtraHosts(t *testing.T) {
+	hosts := []string{"dut:10.42.0.10", "gateway:host-gateway", "ipv6:fd00::10"}
+	parsed, err := parseExtraHosts(hosts)
+	assert.NoError(t, err)
+	assert.Equal(t, hosts, parsed)
+
+	for _, invalid := range []string{"dut", ":10.42.0.10", "dut:rig.example.com"} {
+		_, err = parseExtraHosts([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseDNSServers(t *testing.T) {
+	_, err := parseDNSServers([]string{"10.42.0.1", "fd00::1"})
+	assert.NoError(t, err)
+	_, err = parseDNSServers([]string{"dns.example.com"})
+	assert.Error(t, err)
+}
+
+func TestValidateNetworkSubnet(t *testing.T) {
+	assert.NoError(t, validateNetworkSubnet("", ""))
+	assert.NoError(t, validateNetworkSubnet("10.42.0.0/24", ""))
+	assert.NoError(t, validateNetworkSubnet("10.42.0.0/24", "10.42.0.1"))
+	assert.Error(t, validateNetworkSubnet("10.42.0.0", ""))
+	assert.Error(t, validateNetworkSubnet("10.42.0.0/24", "10.43.0.1"))
+	assert.Error(t, validateNetworkSubnet("", "10.42.0.1"))
+}
+
+func TestEnsureWorkerNetwork(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Name = "rig-1"
+	a.OrgName = "resim"
+	ctx := context.Background()
+
+	// The bridge and host networks always exist
+	a.DockerNetworkMode = DockerNetworkModeBridge
+	assert.NoError(t, a.ensureWorkerNetwork(ctx))
+
+	a.DockerNetworkMode = "hil-net"
+	mockDocker.On("NetworkInspect", mock.Anything, "hil-net", network.InspectOptions{}).Return(network.Inspect{Name: "hil-net", Driver: "macvlan"}, nil).Once()
+	assert.NoError(t, a.ensureWorkerNetwork(ctx), "existing networks are used as they are")
+
+	a.DockerNetworkSubnet = "10.42.0.0/24"
+	a.DockerNetworkGateway = "10.42.0.1"
+	mockDocker.On("NetworkInspect", mock.Anything, "hil-net", network.InspectOptions{}).Return(network.Inspect{}, errdefs.NotFound(errors.New("network hil-net not found"))).Once()
+	mockDocker.On("NetworkCreate", mock.Anything, "hil-net", network.CreateOptions{
+		Driver: "bridge",
+		Labels: map[string]string{WorkerLabelAgentName: "rig-1", WorkerLabelOrg: "resim"},
+		IPAM: &network.IPAM{
+			Config: []network.IPAMConfig{{Subnet: "10.42.0.0/24", Gateway: "10.42.0.1"}},
+		},
+	}).Return(network.CreateResponse{ID: "1234"}, nil).Once()
+	assert.NoError(t, a.ensureWorkerNetwork(ctx))
+
+	mockDocker.On("NetworkInspect", mock.Anything, "hil-net", network.InspectOptions{}).Return(network.Inspect{}, errors.New("permission denied")).Once()
+	assert.ErrorContains(t, a.ensureWorkerNetwork(ctx), "error inspecting worker network hil-net")
+}
+
+func TestWorkerNetworking(t *testing.T) {
+	a := New(nil)
+	a.DockerNetworkMode = DockerNetworkModeBridge
+	a.CustomerWorkerConfig.DNS = []string{"10.42.0.1"}
+	a.CustomerWorkerConfig.DNSSearch = []string{"rig.example.com"}
+	a.CustomerWorkerConfig.ExtraHosts = []string{"dut:10.42.0.10"}
+
+	hostConfig := &container.HostConfig{}
+	networkingConfig := a.workerNetworking(hostConfig)
+	assert.Equal(t, &network.NetworkingConfig{}, networkingConfig)
+	assert.Equal(t, container.NetworkMode(""), hostConfig.NetworkMode, "the worker runs on the default network")
+	assert.Equal(t, []string{"10.42.0.1"}, hostConfig.DNS)
+	assert.Equal(t, []string{"rig.example.com"}, hostConfig.DNSSearch)
+	assert.Equal(t, []string{"dut:10.42.0.10"}, hostConfig.ExtraHosts)
+
+	a.DockerNetworkMode = "hil-net"
+	hostConfig = &container.HostConfig{}
+	networkingConfig = a.workerNetworking(hostConfig)
+	assert.Equal(t, container.NetworkMode("hil-net"), hostConfig.NetworkMode)
+	assert.Contains(t, networkingConfig.EndpointsConfig, "hil-net")
+}
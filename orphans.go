@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Labels on worker containers, identifying the agent that started them
+const (
+	WorkerLabelAgentName = "ai.resim.agent.name"
+	WorkerLabelOrg       = "ai.resim.agent.org"
+	WorkerLabelVersion   = "ai.resim.agent.version"
+	WorkerLabelWorkerID  = "ai.resim.agent.worker-id"
+)
+
+func (a *Agent) workerLabels() map[string]string {
+	return map[string]string{
+		WorkerLabelAgentName: a.Name,
+		WorkerLabelOrg:       a.OrgName,
+		WorkerLabelVersion:   agentVersion,
+		WorkerLabelWorkerID:  a.currentWorkerID,
+	}
+}
+
+// workerDirName is the name of a worker's directory in the worker directory.
+func workerDirName(workerID string) string {
+	return "worker-" + workerID
+}
+
+// recoverWorkers finds worker containers left behind by a previous run of the
+// agent, e.g. if it was killed. The most recent running worker is adopted: the
+// agent watches it until it exits, as it would have done. Other workers are
+// removed, along with worker directories that are left without a container.
+func (a *Agent) recoverWorkers(ctx context.Context) error {
+	containers, err := a.Docker.ContainerList(ctx, container.ListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", WorkerLabelAgentName+"="+a.Name),
+			filters.Arg("label", WorkerLabelOrg+"="+a.OrgName),
+		),
+	})
+	if err != nil {
+		return fmt.Errorf("error listing worker containers: %w", err)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Created > containers[j].Created
+	})
+
+	var adopt *types.Container
+	// The directories of the adopted worker, and of workers that couldn't be removed
+	keepDirs := map[string]bool{}
+	for i, c := range containers {
+		if c.State == "running" && adopt == nil {
+			adopt = &containers[i]
+			keepDirs[workerDirName(c.Labels[WorkerLabelWorkerID])] = true
+			continue
+		}
+		if !a.removeStaleWorker(ctx, c) {
+			keepDirs[workerDirName(c.Labels[WorkerLabelWorkerID])] = true
+		}
+	}
+	if a.RemoveWorkerDir {
+		a.removeStaleWorkerDirs(keepDirs)
+	}
+	if adopt == nil {
+		return nil
+	}
+	return a.adoptWorker(ctx, *adopt)
+}
+
+// adoptWorker watches a worker started by a previous run of the agent until it
+// exits, then removes it. As for the agent's own workers, the post-task hooks are
+// run and the outcome reported.
+func (a *Agent) adoptWorker(ctx context.Context, c types.Container) error {
+	a.currentWorkerID = c.Labels[WorkerLabelWorkerID]
+	slog.Info("Adopting running worker", "worker", a.currentWorkerID, "container", c.ID, "image", c.Image, "agent_version", c.Labels[WorkerLabelVersion])
+	a.setWorkerImage(c.Image)
+	a.workerStarted(c.ID)
+	workerStart := time.Unix(c.Created, 0)
+	err := a.watchWorker(ctx, c.ID, workerStart)
+	a.setWorkerState(WorkerStateIdle)
+	a.removeContainer(ctx, c.ID)
+	a.runPostTaskHooks(ctx, c.Image, err, workerStart)
+	a.reportWorkerOutcome(ctx, err)
+	if workerErrorCounts(err) {
+		return err
+	}
+	return nil
+}
+
+// removeStaleWorker removes a worker container that is no longer supervised,
+// stopping it if it is still running. It reports whether it was removed.
+func (a *Agent) removeStaleWorker(ctx context.Context, c types.Container) bool {
+	slog.Info("Removing stale worker", "worker", c.Labels[WorkerLabelWorkerID], "container", c.ID, "state", c.State, "agent_version", c.Labels[WorkerLabelVersion])
+	err := a.Docker.ContainerRemove(ctx, c.ID, container.RemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
+	})
+	if err != nil {
+		slog.Warn("Error removing stale worker", "container", c.ID, "err", err)
+		return false
+	}
+	return true
+}
+
+// removeStaleWorkerDirs removes the workers' directories in the worker directory,
+// other than those in keep, as no worker container uses them.
+func (a *Agent) removeStaleWorkerDirs(keep map[string]bool) {
+	subpaths, err := os.ReadDir(a.WorkerDir)
+	if err != nil {
+		slog.Warn("Error reading worker directory", "error", err, "path", a.WorkerDir)
+		return
+	}
+	for _, subpath := range subpaths {
+		if !subpath.IsDir() || !strings.HasPrefix(subpath.Name(), workerDirName("")) || keep[subpath.Name()] {
+			continue
+		}
+		removePath := filepath.Join(a.WorkerDir, subpath.Name())
+		slog.Info("Removing stale worker directory", "path", removePath)
+		err = os.RemoveAll(removePath)
+		if err != nil {
+			slog.Warn("Error while deleting worker directory", "error", err, "path", removePath)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWorkerLabels(t *testing.T) {
+	a := New(nil)
+	a.Name = "rig-1"
+	a.OrgName = "resim"
+	a.currentWorkerID = "1234"
+	assert.Equal(t, map[string]string{
+		WorkerLabelAgentName: "rig-1",
+		WorkerLabelOrg:       "resim",
+		WorkerLabelVersion:   agentVersion,
+		WorkerLabelWorkerID:  "1234",
+	}, a.workerLabels())
+}
+
+func TestRecoverWorkers(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Name = "rig-1"
+	a.OrgName = "resim"
+	a.RemoveWorkerDir = true
+	a.WorkerDir = t.TempDir()
+	// worker-orphaned has no container left, and not-worker-exited isn't a worker's directory
+	for _, dir := range []string{"cache", "not-worker-exited", "worker-adopted", "worker-exited", "worker-older", "worker-orphaned", "worker-stuck"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(a.WorkerDir, dir), 0700))
+	}
+	hookOutput := filepath.Join(t.TempDir(), "hook-output")
+	a.PostTaskHooks = []TaskHook{{Command: []string{"sh", "-c", `echo "$RESIM_WORKER_ID $RESIM_WORKER_OUTCOME" > ` + hookOutput}}}
+	a.HookTimeout = time.Minute
+	ctx := context.Background()
+
+	labels := func(workerID string) map[string]string {
+		return map[string]string{WorkerLabelAgentName: "rig-1", WorkerLabelOrg: "resim", WorkerLabelVersion: "v1.1.1", WorkerLabelWorkerID: workerID}
+	}
+	mockDocker.On("ContainerList", mock.Anything, container.ListOptions{
+		All: true,
+		Filters: filters.NewArgs(
+			filters.Arg("label", WorkerLabelAgentName+"=rig-1"),
+			filters.Arg("label", WorkerLabelOrg+"=resim"),
+		),
+	}).Return([]types.Container{
+		{ID: "exited", State: "exited", Created: 3, Labels: labels("exited")},
+		{ID: "older", State: "running", Created: 1, Labels: labels("older")},
+		{ID: "stuck", State: "running", Created: 0, Labels: labels("stuck")},
+		{ID: "adopted", State: "running", Created: 2, Labels: labels("adopted"), Image: "public.ecr.aws/resim/experience-worker:latest"},
+	}, nil).Once()
+
+	// Stale workers are removed, even if they are still running
+	forceRemove := container.RemoveOptions{RemoveVolumes: true, Force: true}
+	mockDocker.On("ContainerRemove", mock.Anything, "exited", forceRemove).Return(nil).Once()
+	mockDocker.On("ContainerRemove", mock.Anything, "older", forceRemove).Return(nil).Once()
+	mockDocker.On("ContainerRemove", mock.Anything, "stuck", forceRemove).Return(errors.New("device or resource busy")).Once()
+
+	// The most recent running worker is watched until it exits
+	mockDocker.On("ContainerInspect", mock.Anything, "adopted").Return(types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "exited"}},
+	}, nil).Once().Run(func(args mock.Arguments) {
+		state := a.getState()
+		assert.Equal(t, WorkerStateRunning, state.workerState)
+		assert.Equal(t, "adopted", state.workerContainerID)
+		assert.Equal(t, "adopted", a.currentWorkerID)
+	})
+	mockDocker.On("ContainerRemove", mock.Anything, "adopted", container.RemoveOptions{RemoveVolumes: true}).Return(nil).Once()
+
+	assert.NoError(t, a.recoverWorkers(ctx))
+	assert.Equal(t, WorkerStateIdle, a.getState().workerState)
+
+	remaining, err := os.ReadDir(a.WorkerDir)
+	assert.NoError(t, err)
+	var names []string
+	for _, entry := range remaining {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"cache", "not-worker-exited", "worker-adopted", "worker-stuck"}, names, "the adopted worker cleans up its own directory")
+
+	// The adopted worker's post-task hooks are run
+	output, err := os.ReadFile(hookOutput)
+	assert.NoError(t, err)
+	assert.Equal(t, "adopted succeeded\n", string(output))
+
+	mockDocker.On("ContainerList", mock.Anything, mock.Anything).Return([]types.Container{}, errors.New("permission denied")).Once()
+	assert.ErrorContains(t, a.recoverWorkers(ctx), "error listing worker containers")
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/resim-ai/agent/api"
+)
+
+// WorkerOutcome classifies how a worker run ended. It is the outcome label on
+// worker metrics.
+type WorkerOutcome string
+
+const (
+	WorkerOutcomeSucceeded WorkerOutcome = "succeeded"
+	// WorkerOutcomeFailed is a worker that exited non-zero
+	WorkerOutcomeFailed WorkerOutcome = "failed"
+	// WorkerOutcomeOOMKilled is a worker killed for running out of memory
+	WorkerOutcomeOOMKilled WorkerOutcome = "oom-killed"
+	// WorkerOutcomeSignalled is a worker killed by a signal other than the agent's
+	WorkerOutcomeSignalled WorkerOutcome = "signalled"
+	// WorkerOutcomeCancelled is a worker stopped with ctl cancel
+	WorkerOutcomeCancelled WorkerOutcome = "cancelled"
+	// WorkerOutcomeTimeout is a worker stopped for running past its timeout
+	WorkerOutcomeTimeout WorkerOutcome = "timeout"
+	// WorkerOutcomeDaemonError is the container runtime failing to create, run or inspect the worker
+	WorkerOutcomeDaemonError WorkerOutcome = "daemon-error"
+	// WorkerOutcomeStartFailed is a worker container that was created but couldn't be started
+	WorkerOutcomeStartFailed WorkerOutcome = "start-failed"
+	// WorkerOutcomeImageMissing is a worker image that isn't present for the agent's platform
+	WorkerOutcomeImageMissing WorkerOutcome = "image-missing"
+)
+
+// countsAsError reports whether the outcome is a problem with the agent or its
+// host, which counts towards MaxErrorCount. Workers that fail, e.g. as a workload
+// ran out of memory, don't stop the agent from taking more work.
+func (o WorkerOutcome) countsAsError() bool {
+	switch o {
+	case WorkerOutcomeTimeout, WorkerOutcomeDaemonError, WorkerOutcomeStartFailed, WorkerOutcomeImageMissing:
+		return true
+	default:
+		return false
+	}
+}
+
+// reportable reports whether the outcome is one the worker can't have reported
+// itself, as it was killed, timed out or never ran, which the agent reports to
+// the Agent API. A worker that failed exited on its own terms, having reported its
+// task's status, and one that was signalled or cancelled was stopped deliberately.
+func (o WorkerOutcome) reportable() bool {
+	switch o {
+	case WorkerOutcomeOOMKilled, WorkerOutcomeTimeout, WorkerOutcomeStartFailed, WorkerOutcomeDaemonError, WorkerOutcomeImageMissing:
+		return true
+	default:
+		return false
+	}
+}
+
+// WorkerRunError is returned when a worker run doesn't succeed.
+type WorkerRunError struct {
+	Outcome  WorkerOutcome
+	ExitCode int
+	Err      error
+}
+
+func (e *WorkerRunError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("worker %v: %v", e.Outcome, e.Err)
+	}
+	return fmt.Sprintf("worker %v with exit code %v", e.Outcome, e.ExitCode)
+}
+
+func (e *WorkerRunError) Unwrap() error {
+	return e.Err
+}
+
+// workerErrorCounts reports whether an error running the worker counts towards
+// MaxErrorCount. Errors that aren't classified, e.g. failing to prepare the
+// worker's mounts, count.
+func workerErrorCounts(err error) bool {
+	var runErr *WorkerRunError
+	if errors.As(err, &runErr) {
+		return runErr.Outcome.countsAsError()
+	}
+	return err != nil
+}
+
+// classifyExit classifies how a worker's container exited. The agent stopping the
+// worker takes precedence, as the worker exits with SIGTERM's exit code.
+func classifyExit(state *types.ContainerState, cancelled bool, timedOut bool) WorkerOutcome {
+	switch {
+	case timedOut:
+		return WorkerOutcomeTimeout
+	case cancelled:
+		return WorkerOutcomeCancelled
+	case state.OOMKilled:
+		return WorkerOutcomeOOMKilled
+	case state.Error != "":
+		return WorkerOutcomeDaemonError
+	case state.ExitCode == 0:
+		return WorkerOutcomeSucceeded
+	case state.ExitCode > 128:
+		// Shells and the runtime report death by a signal as 128 + the signal
+		return WorkerOutcomeSignalled
+	default:
+		return WorkerOutcomeFailed
+	}
+}
+
+// classifyCreateError classifies an error creating the worker's container.
+func classifyCreateError(err error) WorkerOutcome {
+	var platformErr *ImagePlatformError
+	if errdefs.IsNotFound(err) || errors.As(err, &platformErr) {
+		return WorkerOutcomeImageMissing
+	}
+	return WorkerOutcomeDaemonError
+}
+
+// recordWorkerOutcome logs how a worker run ended, and records it in metrics and
+// the agent's status.
+func (a *Agent) recordWorkerOutcome(outcome WorkerOutcome, exitCode int, detail string, duration time.Duration) {
+	attrs := []any{"worker", a.currentWorkerID, "outcome", outcome, "exit_code", exitCode, "counts_as_error", outcome.countsAsError()}
+	if detail != "" {
+		attrs = append(attrs, "err", detail)
+	}
+	switch outcome {
+	case WorkerOutcomeSucceeded:
+		slog.Info("Worker succeeded", attrs...)
+	case WorkerOutcomeCancelled:
+		slog.Info("Worker cancelled", attrs...)
+	case WorkerOutcomeFailed:
+		slog.Warn("Worker container exited non-zero", attrs...)
+	case WorkerOutcomeOOMKilled:
+		slog.Error("Worker was killed for running out of memory", attrs...)
+	case WorkerOutcomeSignalled:
+		slog.Error("Worker was killed by a signal", attrs...)
+	default:
+		slog.Error("Worker did not run to completion", attrs...)
+	}
+
+	workerRunsTotal.WithLabelValues(string(outcome)).Inc()
+	if duration > 0 {
+		workerDuration.WithLabelValues(string(outcome)).Observe(duration.Seconds())
+	}
+
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.lastWorkerOutcome = outcome
+	a.state.lastWorkerExitCode = exitCode
+}
+
+// reportWorkerOutcome reports a worker run with a reportable outcome to the Agent
+// API, as a heartbeat with an ERROR task status, since a worker that was killed,
+// timed out or never started can't report its task's status itself. The worker
+// polls for its tasks, so the agent doesn't know the task's name to update it
+// directly. What the Agent API does with an ERROR heartbeat without a task name
+// hasn't been confirmed; it may only record the agent's status. Errors before the
+// worker was created, e.g. preparing its mounts, aren't reported, as no task was
+// taken.
+func (a *Agent) reportWorkerOutcome(ctx context.Context, workerErr error) {
+	var runErr *WorkerRunError
+	if !errors.As(workerErr, &runErr) || !runErr.Outcome.reportable() {
+		return
+	}
+	ctx, span := startSpan(ctx, "agent.report_outcome")
+	var err error
+	defer func() { endSpan(span, err) }()
+
+	res, err := a.APIClient.AgentHeartbeatWithResponse(ctx, api.AgentHeartbeatInput{
+		AgentName:  &a.Name,
+		PoolLabels: Ptr(a.advertisedPoolLabels()),
+		TaskStatus: Ptr(api.ERROR),
+	})
+	if err == nil && res.StatusCode() != http.StatusOK {
+		err = fmt.Errorf("unexpected status %v", res.StatusCode())
+	}
+	if err != nil {
+		slog.Warn("Error reporting worker outcome to the Agent API", "worker", a.currentWorkerID, "outcome", runErr.Outcome, "err", err)
+		workerOutcomeReportsTotal.WithLabelValues("failure").Inc()
+		return
+	}
+	workerOutcomeReportsTotal.WithLabelValues("success").Inc()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/errdefs"
+	"github.com/resim-ai/agent/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestClassifyExit(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		state     types.ContainerState
+		cancelled bool
+		timedOut  bool
+		expected  WorkerOutcome
+	}{
+		{"succeeded", types.ContainerState{}, false, false, WorkerOutcomeSucceeded},
+		{"failed", types.ContainerState{ExitCode: 1}, false, false, WorkerOutcomeFailed},
+		{"oom killed", types.ContainerState{ExitCode: 137, OOMKilled: true}, false, false, WorkerOutcomeOOMKilled},
+		{"signalled", types.ContainerState{ExitCode: 137}, false, false, WorkerOutcomeSignalled},
+		{"daemon error", types.ContainerState{ExitCode: 128, Error: "failed to create task"}, false, false, WorkerOutcomeDaemonError},
+		{"cancelled", types.ContainerState{ExitCode: 143}, true, false, WorkerOutcomeCancelled},
+		{"timeout", types.ContainerState{ExitCode: 137, OOMKilled: true}, true, true, WorkerOutcomeTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, classifyExit(&tc.state, tc.cancelled, tc.timedOut))
+		})
+	}
+}
+
+func TestClassifyCreateError(t *testing.T) {
+	assert.Equal(t, WorkerOutcomeImageMissing, classifyCreateError(errdefs.NotFound(errors.New("No such image: worker:latest"))))
+	assert.Equal(t, WorkerOutcomeImageMissing, classifyCreateError(&ImagePlatformError{Image: "worker:latest", Platform: "linux/arm64", Err: errors.New("no matching manifest for linux/arm64")}))
+	assert.Equal(t, WorkerOutcomeDaemonError, classifyCreateError(errors.New("Cannot connect to the Docker daemon")))
+}
+
+func TestWorkerErrorCounts(t *testing.T) {
+	assert.False(t, workerErrorCounts(nil))
+	assert.True(t, workerErrorCounts(errors.New("error getting mounts")), "unclassified errors count")
+	for outcome, counts := range map[WorkerOutcome]bool{
+		WorkerOutcomeFailed:       false,
+		WorkerOutcomeOOMKilled:    false,
+		WorkerOutcomeSignalled:    false,
+		WorkerOutcomeCancelled:    false,
+		WorkerOutcomeTimeout:      true,
+		WorkerOutcomeDaemonError:  true,
+		WorkerOutcomeStartFailed:  true,
+		WorkerOutcomeImageMissing: true,
+	} {
+		err := fmt.Errorf("error running ReSim worker: %w", &WorkerRunError{Outcome: outcome})
+		assert.Equal(t, counts, workerErrorCounts(err), outcome)
+	}
+}
+
+func TestWatchWorkerOOMKilled(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.currentWorkerID = "1234"
+
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "exited", ExitCode: 137, OOMKilled: true}},
+	}, nil).Once()
+
+	err := a.watchWorker(context.Background(), "worker", time.Now())
+	var runErr *WorkerRunError
+	assert.True(t, errors.As(err, &runErr))
+	assert.Equal(t, WorkerOutcomeOOMKilled, runErr.Outcome)
+	assert.Equal(t, 137, runErr.ExitCode)
+	assert.False(t, workerErrorCounts(err))
+
+	status := a.CurrentStatus()
+	assert.Equal(t, WorkerOutcomeOOMKilled, status.LastWorkerOutcome)
+	assert.Equal(t, 137, status.LastWorkerExitCode)
+
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(types.ContainerJSON{}, errors.New("connection refused")).Once()
+	err = a.watchWorker(context.Background(), "worker", time.Now())
+	assert.True(t, errors.As(err, &runErr))
+	assert.Equal(t, WorkerOutcomeDaemonError, runErr.Outcome)
+	assert.ErrorContains(t, err, "error inspecting container for worker")
+}
+
+func TestReportWorkerOutcome(t *testing.T) {
+	var heartbeats []api.AgentHeartbeatInput
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/heartbeat", r.URL.Path)
+		var input api.AgentHeartbeatInput
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		heartbeats = append(heartbeats, input)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	a := New(nil)
+	a.Name = "rig-1"
+	a.PoolLabels = []string{"hil"}
+	var err error
+	a.APIClient, err = api.NewClientWithResponses(server.URL)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	a.reportWorkerOutcome(ctx, &WorkerRunError{Outcome: WorkerOutcomeOOMKilled, ExitCode: 137})
+	assert.Len(t, heartbeats, 1)
+	assert.Equal(t, "rig-1", *heartbeats[0].AgentName)
+	assert.Equal(t, []string{"hil"}, *heartbeats[0].PoolLabels)
+	assert.Equal(t, api.ERROR, *heartbeats[0].TaskStatus)
+
+	// Successful workers report their own tasks, and workers that were never created took none
+	a.reportWorkerOutcome(ctx, nil)
+	a.reportWorkerOutcome(ctx, errors.New("error getting mounts"))
+	assert.Len(t, heartbeats, 1)
+
+	// Workers that failed reported their own tasks, and signalled or cancelled ones were stopped deliberately
+	a.reportWorkerOutcome(ctx, &WorkerRunError{Outcome: WorkerOutcomeFailed, ExitCode: 1})
+	a.reportWorkerOutcome(ctx, &WorkerRunError{Outcome: WorkerOutcomeSignalled, ExitCode: 143})
+	a.reportWorkerOutcome(ctx, &WorkerRunError{Outcome: WorkerOutcomeCancelled, ExitCode: 143})
+	assert.Len(t, heartbeats, 1)
+
+	// Failing to report doesn't stop the agent
+	status = http.StatusInternalServerError
+	a.reportWorkerOutcome(ctx, fmt.Errorf("error running worker: %w", &WorkerRunError{Outcome: WorkerOutcomeStartFailed}))
+	assert.Len(t, heartbeats, 2)
+}
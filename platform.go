@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/resim-ai/agent/api"
+)
+
+// parsePlatform parses a platform of the form os/arch[/variant], e.g. linux/arm64.
+func parsePlatform(platform string) (v1.Platform, error) {
+	parts := strings.Split(strings.ToLower(platform), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, fmt.Errorf("invalid platform %q: must be <os>/<arch>[/<variant>], e.g. linux/arm64", platform)
+	}
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func formatPlatform(p v1.Platform) string {
+	if p.Variant != "" {
+		return fmt.Sprintf("%v/%v/%v", p.OS, p.Architecture, p.Variant)
+	}
+	return fmt.Sprintf("%v/%v", p.OS, p.Architecture)
+}
+
+// detectPlatform sets the platform to run the worker on to that of the container
+// runtime, unless one is configured. The runtime may be remote, or run a VM as on
+// macOS, so its platform is used rather than the agent's.
+func (a *Agent) detectPlatform(version types.Version) {
+	if a.Platform.OS != "" {
+		return
+	}
+	a.Platform = v1.Platform{OS: version.Os, Architecture: version.Arch}
+	if a.Platform.OS == "" || a.Platform.Architecture == "" {
+		a.Platform = v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+	}
+}
+
+// ImagePlatformError is returned when the worker image is not available for the
+// agent's platform, which retrying will not fix.
+type ImagePlatformError struct {
+	Image    string
+	Platform string
+	Err      error
+}
+
+func (e *ImagePlatformError) Error() string {
+	return fmt.Sprintf("worker image %v is not available for platform %v; set platform if this host can run another: %v", e.Image, e.Platform, e.Err)
+}
+
+func (e *ImagePlatformError) Unwrap() error {
+	return e.Err
+}
+
+// wrapPlatformError identifies errors from pulling or creating a container from
+// an image that lacks the requested platform.
+func wrapPlatformError(err error, image string, platform v1.Platform) error {
+	if err == nil {
+		return nil
+	}
+	message := err.Error()
+	if strings.Contains(message, "no matching manifest for") || strings.Contains(message, "does not match the specified platform") {
+		return &ImagePlatformError{Image: image, Platform: formatPlatform(platform), Err: err}
+	}
+	return err
+}
+
+// AddAgentPlatformEditor reports the platform the agent runs workers on, so that
+// tasks can be routed to agents that can run them.
+func AddAgentPlatformEditor(platform v1.Platform) api.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		req.Header.Set("X-ReSim-AgentPlatform", formatPlatform(platform))
+		return nil
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlatform(t *testing.T) {
+	platform, err := parsePlatform("linux/arm64")
+	assert.NoError(t, err)
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: "arm64"}, platform)
+	assert.Equal(t, "linux/arm64", formatPlatform(platform))
+
+	platform, err = parsePlatform("Linux/ARM/v7")
+	assert.NoError(t, err)
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, platform)
+	assert.Equal(t, "linux/arm/v7", formatPlatform(platform))
+
+	for _, invalid := range []string{"", "arm64", "linux/", "linux/arm/v7/extra"} {
+		_, err = parsePlatform(invalid)
+		assert.ErrorContains(t, err, "invalid platform", invalid)
+	}
+}
+
+func TestDetectPlatform(t *testing.T) {
+	a := New(nil)
+	a.detectPlatform(types.Version{Os: "linux", Arch: "arm64"})
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: "arm64"}, a.Platform)
+
+	// A configured platform is not overridden
+	a.Platform = v1.Platform{OS: "linux", Architecture: "amd64"}
+	a.detectPlatform(types.Version{Os: "linux", Arch: "arm64"})
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: "amd64"}, a.Platform)
+
+	// If the runtime doesn't say, fall back to the agent's architecture
+	a = New(nil)
+	a.detectPlatform(types.Version{})
+	assert.Equal(t, v1.Platform{OS: "linux", Architecture: runtime.GOARCH}, a.Platform)
+}
+
+func TestWrapPlatformError(t *testing.T) {
+	platform := v1.Platform{OS: "linux", Architecture: "arm64"}
+	assert.NoError(t, wrapPlatformError(nil, "worker:latest", platform))
+
+	err := errors.New("pull access denied")
+	assert.Equal(t, err, wrapPlatformError(err, "worker:latest", platform))
+
+	err = wrapPlatformError(errors.New("image with reference worker:latest was found but does not match the specified platform: wanted linux/arm64"), "worker:latest", platform)
+	var platformErr *ImagePlatformError
+	assert.ErrorAs(t, err, &platformErr)
+	assert.Equal(t, "linux/arm64", platformErr.Platform)
+	assert.ErrorContains(t, err, "worker image worker:latest is not available for platform linux/arm64")
+}
+
+func TestAddAgentPlatformEditor(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://agentapi.resim.ai/agent/v1/agent/checkin", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, AddAgentPlatformEditor(v1.Platform{OS: "linux", Architecture: "arm64"})(context.Background(), req))
+	assert.Equal(t, "linux/arm64", req.Header.Get("X-ReSim-AgentPlatform"))
+}
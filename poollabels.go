@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DevicePoolLabel is a pool label advertised while a device node matching Path,
+// which may be a glob such as /dev/ttyUSB*, exists.
+type DevicePoolLabel struct {
+	Label string `mapstructure:"label"`
+	Path  string `mapstructure:"path"`
+}
+
+// PoolLabelScript is a command whose output, one label per line, is advertised
+// as pool labels.
+type PoolLabelScript struct {
+	Name    string   `mapstructure:"name"`
+	Command []string `mapstructure:"command"`
+	// Timeout is how long the script may run for; PoolLabelScriptTimeout if zero
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func (s PoolLabelScript) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Command[0]
+}
+
+// validateDynamicPoolLabels checks the device labels and label scripts.
+func validateDynamicPoolLabels(devices []DevicePoolLabel, scripts []PoolLabelScript) error {
+	for i, device := range devices {
+		if device.Label == "" || device.Path == "" {
+			return fmt.Errorf("device label %v must have a label and a path", i+1)
+		}
+		if _, err := filepath.Match(device.Path, ""); err != nil {
+			return fmt.Errorf("device label %v has an invalid path: %w", device.Label, err)
+		}
+	}
+	for i, script := range scripts {
+		if len(script.Command) == 0 || script.Command[0] == "" {
+			return fmt.Errorf("script %v has no command", i+1)
+		}
+		if script.Timeout < 0 {
+			return fmt.Errorf("script %v has a negative timeout", script.name())
+		}
+	}
+	return nil
+}
+
+// hostFactPoolLabels returns labels for the facts of the container runtime's
+// host: its architecture, CPU count, memory in GiB and kernel version. The
+// runtime is asked, so that they are those of the host the worker runs on even
+// when the agent is containerised.
+func (a *Agent) hostFactPoolLabels(ctx context.Context) ([]string, error) {
+	info, err := a.Docker.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting host facts from the container runtime: %w", err)
+	}
+	arch := a.Platform.Architecture
+	if arch == "" {
+		arch = runtime.GOARCH
+	}
+	labels := []string{
+		"arch=" + arch,
+		fmt.Sprintf("cpus=%v", info.NCPU),
+		fmt.Sprintf("memory-gb=%v", info.MemTotal/(1<<30)),
+	}
+	if info.KernelVersion != "" {
+		labels = append(labels, "kernel="+info.KernelVersion)
+	}
+	return labels, nil
+}
+
+// devicePoolLabels returns the labels of the devices that are present.
+func (a *Agent) devicePoolLabels() []string {
+	var labels []string
+	for _, device := range a.DevicePoolLabels {
+		matches, _ := filepath.Glob(device.Path)
+		if len(matches) > 0 {
+			labels = append(labels, device.Label)
+		}
+	}
+	return labels
+}
+
+// runPoolLabelScript runs a label script, returning the labels it printed.
+func (a *Agent) runPoolLabelScript(ctx context.Context, script PoolLabelScript) ([]string, error) {
+	timeout := script.Timeout
+	if timeout == 0 {
+		timeout = a.PoolLabelScriptTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script.Command[0], script.Command[1:]...)
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out after %v", timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var labels []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if label := strings.TrimSpace(line); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels, nil
+}
+
+// evaluateDynamicPoolLabels computes the dynamic pool labels and records them.
+// Labels from a source that fails are left out until it succeeds, so that work
+// isn't routed on labels that can't be confirmed.
+func (a *Agent) evaluateDynamicPoolLabels(ctx context.Context) []string {
+	var labels []string
+	if a.HostFactPoolLabels {
+		hostLabels, err := a.hostFactPoolLabels(ctx)
+		if err != nil {
+			slog.Warn("Error evaluating host fact pool labels", "err", err)
+		}
+		labels = append(labels, hostLabels...)
+	}
+	labels = append(labels, a.devicePoolLabels()...)
+	for _, script := range a.PoolLabelScripts {
+		scriptLabels, err := a.runPoolLabelScript(ctx, script)
+		if err != nil {
+			slog.Warn("Error running pool label script", "script", script.name(), "err", err)
+			continue
+		}
+		labels = append(labels, scriptLabels...)
+	}
+	slices.Sort(labels)
+	labels = slices.Compact(labels)
+
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	if !slices.Equal(labels, a.state.dynamicPoolLabels) {
+		slog.Info("Dynamic pool labels changed", "labels", labels, "previous", a.state.dynamicPoolLabels)
+	}
+	a.state.dynamicPoolLabels = labels
+	return labels
+}
+
+// poolLabels returns the configured pool labels and the dynamic pool labels
+// when they were last evaluated.
+func (a *Agent) poolLabels() []string {
+	labels := slices.Clone(a.PoolLabels)
+	for _, label := range a.getState().dynamicPoolLabels {
+		if !slices.Contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// hasDynamicPoolLabels reports whether any dynamic pool labels are configured.
+func (a *Agent) hasDynamicPoolLabels() bool {
+	return a.HostFactPoolLabels || len(a.DevicePoolLabels) > 0 || len(a.PoolLabelScripts) > 0
+}
+
+// startPoolLabelRefresh evaluates the dynamic pool labels, and then re-evaluates
+// them every PoolLabelsRefreshInterval until ctx is cancelled, so that checkins
+// advertise the hardware currently attached to the rig.
+func (a *Agent) startPoolLabelRefresh(ctx context.Context) {
+	if !a.hasDynamicPoolLabels() {
+		return
+	}
+	a.evaluateDynamicPoolLabels(ctx)
+	ticker := time.NewTicker(a.PoolLabelsRefreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.evaluateDynamicPoolLabels(ctx)
+			}
+		}
+	}()
+}
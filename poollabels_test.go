@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/system"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/resim-ai/agent/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestValidateDynamicPoolLabels(t *testing.T) {
+	assert.NoError(t, validateDynamicPoolLabels(
+		[]DevicePoolLabel{{Label: "can", Path: "/dev/can*"}},
+		[]PoolLabelScript{{Command: []string{"/opt/rig/labels.sh"}}},
+	))
+	assert.ErrorContains(t, validateDynamicPoolLabels([]DevicePoolLabel{{Label: "can"}}, nil), "must have a label and a path")
+	assert.ErrorContains(t, validateDynamicPoolLabels([]DevicePoolLabel{{Label: "can", Path: "/dev/can["}}, nil), "invalid path")
+	assert.ErrorContains(t, validateDynamicPoolLabels(nil, []PoolLabelScript{{Name: "labels"}}), "script 1 has no command")
+}
+
+func TestHostFactPoolLabels(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Platform = v1.Platform{OS: "linux", Architecture: "arm64"}
+
+	mockDocker.On("Info", mock.Anything).Return(system.Info{NCPU: 12, MemTotal: 64*(1<<30) - 1, KernelVersion: "5.15.148-tegra"}, nil).Once()
+	labels, err := a.hostFactPoolLabels(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"arch=arm64", "cpus=12", "memory-gb=63", "kernel=5.15.148-tegra"}, labels)
+
+	mockDocker.On("Info", mock.Anything).Return(system.Info{}, errors.New("connection refused")).Once()
+	_, err = a.hostFactPoolLabels(context.Background())
+	assert.ErrorContains(t, err, "error getting host facts")
+}
+
+func TestEvaluateDynamicPoolLabels(t *testing.T) {
+	dir := t.TempDir()
+	a := New(nil)
+	a.PoolLabelScriptTimeout = 5 * time.Second
+	a.PoolLabels = []string{"hil", "can"}
+	a.DevicePoolLabels = []DevicePoolLabel{
+		{Label: "can", Path: filepath.Join(dir, "can*")},
+		{Label: "serial", Path: filepath.Join(dir, "ttyUSB*")},
+	}
+	a.PoolLabelScripts = []PoolLabelScript{
+		{Name: "dut", Command: []string{"sh", "-c", "echo dut-rev-b; echo; echo '  lidar  '"}},
+		{Name: "broken", Command: []string{"sh", "-c", "echo should-not-appear; exit 1"}},
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ttyUSB0"), nil, 0600))
+
+	labels := a.evaluateDynamicPoolLabels(context.Background())
+	assert.Equal(t, []string{"dut-rev-b", "lidar", "serial"}, labels, "labels from failing scripts are left out")
+	assert.Equal(t, []string{"hil", "can", "dut-rev-b", "lidar", "serial"}, a.poolLabels())
+	assert.Equal(t, a.poolLabels(), a.CurrentStatus().PoolLabels)
+
+	// Labels follow the devices that are attached
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "can0"), nil, 0600))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "ttyUSB0")))
+	labels = a.evaluateDynamicPoolLabels(context.Background())
+	assert.Equal(t, []string{"can", "dut-rev-b", "lidar"}, labels)
+	assert.Equal(t, []string{"hil", "can", "dut-rev-b", "lidar"}, a.poolLabels(), "labels are only advertised once")
+}
+
+func TestCheckinAdvertisesDynamicPoolLabels(t *testing.T) {
+	var checkinPoolLabels []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input api.AgentCheckinInput
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		checkinPoolLabels = *input.PoolLabels
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"workerImageURI": "worker:latest"}`))
+	}))
+	defer server.Close()
+
+	a := New(nil)
+	a.Name = "rig-1"
+	a.PoolLabels = []string{"hil"}
+	a.PoolLabelScriptTimeout = 5 * time.Second
+	a.PoolLabelScripts = []PoolLabelScript{{Command: []string{"echo", "dut-rev-b"}}}
+	var err error
+	a.APIClient, err = api.NewClientWithResponses(server.URL)
+	assert.NoError(t, err)
+
+	a.evaluateDynamicPoolLabels(context.Background())
+	_, err = a.checkin(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hil", "dut-rev-b"}, checkinPoolLabels)
+}
+
+func TestStartPoolLabelRefreshStops(t *testing.T) {
+	dir := t.TempDir()
+	a := New(nil)
+	a.PoolLabelsRefreshInterval = time.Millisecond
+	a.DevicePoolLabels = []DevicePoolLabel{{Label: "can", Path: filepath.Join(dir, "can*")}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.startPoolLabelRefresh(ctx)
+	assert.Empty(t, a.poolLabels())
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "can0"), nil, 0600))
+	assert.Eventually(t, func() bool { return len(a.poolLabels()) == 1 }, 5*time.Second, time.Millisecond)
+
+	// Once cancelled, the labels are no longer re-evaluated
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, os.Remove(filepath.Join(dir, "can0")))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []string{"can"}, a.poolLabels())
+}
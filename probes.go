@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// HealthProbe checks that a rig's hardware is connected and working. Exactly one
+// of Command, TCP, HTTP or Device is set.
+type HealthProbe struct {
+	Name string `mapstructure:"name"`
+	// Command passes if it exits 0
+	Command []string `mapstructure:"command"`
+	// TCP passes if a connection can be made to the host:port
+	TCP string `mapstructure:"tcp"`
+	// HTTP passes if a GET of the URL returns a 2xx status
+	HTTP string `mapstructure:"http"`
+	// Device passes if the device node, e.g. /dev/ttyUSB0, exists
+	Device string `mapstructure:"device"`
+	// Timeout is how long the probe may take; HealthProbeTimeout if zero
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// validateHealthProbes checks that each probe has a unique name and exactly one
+// check.
+func validateHealthProbes(probes []HealthProbe) error {
+	names := map[string]bool{}
+	for i, probe := range probes {
+		if probe.Name == "" {
+			return fmt.Errorf("probe %v has no name", i+1)
+		}
+		if names[probe.Name] {
+			return fmt.Errorf("probe %v is defined more than once", probe.Name)
+		}
+		names[probe.Name] = true
+		checks := 0
+		for _, set := range []bool{len(probe.Command) > 0, probe.TCP != "", probe.HTTP != "", probe.Device != ""} {
+			if set {
+				checks++
+			}
+		}
+		if checks != 1 {
+			return fmt.Errorf("probe %v must have one of command, tcp, http or device", probe.Name)
+		}
+		if probe.Timeout < 0 {
+			return fmt.Errorf("probe %v has a negative timeout", probe.Name)
+		}
+	}
+	return nil
+}
+
+// probeHTTPClient makes HTTP probes. Probes are of hardware on the rig's network,
+// so don't go through the agent's proxy.
+var probeHTTPClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+// runProbe runs a probe, returning why it failed, if it did.
+func (a *Agent) runProbe(ctx context.Context, probe HealthProbe) error {
+	timeout := probe.Timeout
+	if timeout == 0 {
+		timeout = a.HealthProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch {
+	case len(probe.Command) > 0:
+		cmd := exec.CommandContext(ctx, probe.Command[0], probe.Command[1:]...)
+		cmd.WaitDelay = hookWaitDelay
+		output, err := cmd.CombinedOutput()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		if err != nil {
+			if detail := strings.TrimSpace(string(output)); detail != "" {
+				return fmt.Errorf("%w: %v", err, detail)
+			}
+			return err
+		}
+		return nil
+	case probe.TCP != "":
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", probe.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case probe.HTTP != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.HTTP, nil)
+		if err != nil {
+			return err
+		}
+		res, err := probeHTTPClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return fmt.Errorf("returned %v", res.Status)
+		}
+		return nil
+	default:
+		_, err := os.Stat(probe.Device)
+		return err
+	}
+}
+
+// evaluateProbes runs the health probes and records their results. Changes in a
+// probe's result are logged. Evaluations are serialised, so that probes of the
+// same hardware don't overlap.
+func (a *Agent) evaluateProbes(ctx context.Context) []HealthCheck {
+	if len(a.HealthProbes) == 0 {
+		return nil
+	}
+	a.probeMutex.Lock()
+	defer a.probeMutex.Unlock()
+	return a.runProbes(ctx)
+}
+
+// refreshProbes returns the results of the health probes, evaluating them only if
+// they were last evaluated more than HealthProbeInterval ago.
+func (a *Agent) refreshProbes(ctx context.Context) []HealthCheck {
+	if len(a.HealthProbes) == 0 {
+		return nil
+	}
+	a.probeMutex.Lock()
+	defer a.probeMutex.Unlock()
+	state := a.getState()
+	if !state.probesEvaluatedAt.IsZero() && time.Since(state.probesEvaluatedAt) < a.HealthProbeInterval {
+		return state.probes
+	}
+	return a.runProbes(ctx)
+}
+
+// runProbes runs the health probes and records their results. The caller must
+// hold probeMutex.
+func (a *Agent) runProbes(ctx context.Context) []HealthCheck {
+	ctx, span := startSpan(ctx, "agent.probes")
+	defer span.End()
+
+	previous := map[string]bool{}
+	for _, check := range a.getState().probes {
+		previous[check.Name] = check.OK
+	}
+	results := make([]HealthCheck, 0, len(a.HealthProbes))
+	for _, probe := range a.HealthProbes {
+		check := HealthCheck{Name: probe.Name, OK: true}
+		if err := a.runProbe(ctx, probe); err != nil {
+			check.OK = false
+			check.Detail = err.Error()
+		}
+		wasOK, seen := previous[probe.Name]
+		switch {
+		case !check.OK && (wasOK || !seen):
+			slog.Error("Health probe failed; not taking work until it recovers", "probe", probe.Name, "err", check.Detail)
+		case check.OK && seen && !wasOK:
+			slog.Info("Health probe recovered", "probe", probe.Name)
+		}
+		healthProbeUp.WithLabelValues(probe.Name).Set(boolToFloat(check.OK))
+		results = append(results, check)
+	}
+
+	a.stateMutex.Lock()
+	defer a.stateMutex.Unlock()
+	a.state.probes = results
+	a.state.probesEvaluatedAt = time.Now()
+	return results
+}
+
+// probesHealthy reports whether every health probe passed when they were last
+// evaluated.
+func (a *Agent) probesHealthy() bool {
+	return allHealthy(a.getState().probes)
+}
+
+// probesHealth is the readiness check for the health probes.
+func probesHealth(state agentState) HealthCheck {
+	check := HealthCheck{Name: "probes", OK: true}
+	var failing []string
+	for _, probe := range state.probes {
+		if !probe.OK {
+			failing = append(failing, fmt.Sprintf("%v: %v", probe.Name, probe.Detail))
+		}
+	}
+	if len(failing) > 0 {
+		check.OK = false
+		check.Detail = strings.Join(failing, "; ")
+	}
+	return check
+}
+
+// startHealthProbes evaluates the health probes every HealthProbeInterval, until
+// ctx is cancelled. They are also evaluated before the agent checks in to take
+// work, if the last results are out of date.
+func (a *Agent) startHealthProbes(ctx context.Context) {
+	if len(a.HealthProbes) == 0 {
+		return
+	}
+	a.evaluateProbes(ctx)
+	ticker := time.NewTicker(a.HealthProbeInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.evaluateProbes(ctx)
+			}
+		}
+	}()
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/resim-ai/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateHealthProbes(t *testing.T) {
+	assert.NoError(t, validateHealthProbes([]HealthProbe{
+		{Name: "dut", Command: []string{"/opt/rig/check-dut.sh"}},
+		{Name: "can-gateway", TCP: "10.42.0.10:2000", Timeout: time.Second},
+		{Name: "dut-http", HTTP: "http://10.42.0.10/status"},
+		{Name: "serial", Device: "/dev/ttyUSB0"},
+	}))
+	assert.ErrorContains(t, validateHealthProbes([]HealthProbe{{TCP: "10.42.0.10:2000"}}), "probe 1 has no name")
+	assert.ErrorContains(t, validateHealthProbes([]HealthProbe{{Name: "serial"}}), "must have one of")
+	assert.ErrorContains(t, validateHealthProbes([]HealthProbe{{Name: "serial", Device: "/dev/ttyUSB0", TCP: "10.42.0.10:2000"}}), "must have one of")
+	assert.ErrorContains(t, validateHealthProbes([]HealthProbe{{Name: "serial", Device: "/dev/ttyUSB0"}, {Name: "serial", Device: "/dev/ttyUSB1"}}), "more than once")
+}
+
+func TestRunProbe(t *testing.T) {
+	a := New(nil)
+	a.HealthProbeTimeout = 5 * time.Second
+	ctx := context.Background()
+
+	assert.NoError(t, a.runProbe(ctx, HealthProbe{Name: "true", Command: []string{"true"}}))
+	assert.ErrorContains(t, a.runProbe(ctx, HealthProbe{Name: "dut", Command: []string{"sh", "-c", "echo DUT not powered; exit 1"}}), "DUT not powered")
+	assert.ErrorContains(t, a.runProbe(ctx, HealthProbe{Name: "slow", Command: []string{"sleep", "10"}, Timeout: 100 * time.Millisecond}), "timed out")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	assert.NoError(t, a.runProbe(ctx, HealthProbe{Name: "tcp", TCP: address}))
+	listener.Close()
+	assert.Error(t, a.runProbe(ctx, HealthProbe{Name: "tcp", TCP: address}))
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	assert.NoError(t, a.runProbe(ctx, HealthProbe{Name: "http", HTTP: server.URL}))
+	status = http.StatusServiceUnavailable
+	assert.ErrorContains(t, a.runProbe(ctx, HealthProbe{Name: "http", HTTP: server.URL}), "503")
+
+	device := filepath.Join(t.TempDir(), "ttyUSB0")
+	assert.Error(t, a.runProbe(ctx, HealthProbe{Name: "serial", Device: device}))
+	assert.NoError(t, os.WriteFile(device, nil, 0600))
+	assert.NoError(t, a.runProbe(ctx, HealthProbe{Name: "serial", Device: device}))
+}
+
+func TestProbesGatePoolLabels(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "ttyUSB0")
+	var checkinPoolLabels []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input api.AgentCheckinInput
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		checkinPoolLabels = *input.PoolLabels
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"workerImageURI": "worker:latest"}`))
+	}))
+	defer server.Close()
+
+	a := New(nil)
+	a.Name = "rig-1"
+	a.PoolLabels = []string{"hil", "dut-a"}
+	a.HealthProbeTimeout = time.Second
+	a.HealthProbes = []HealthProbe{{Name: "serial", Device: device}}
+	var err error
+	a.APIClient, err = api.NewClientWithResponses(server.URL)
+	assert.NoError(t, err)
+
+	// No pool labels are advertised while the probe fails
+	a.evaluateProbes(context.Background())
+	_, err = a.checkin(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, checkinPoolLabels)
+	assert.False(t, a.probesHealthy())
+	state := a.getState()
+	check := probesHealth(state)
+	assert.False(t, check.OK)
+	assert.Contains(t, check.Detail, "serial: ")
+	assert.Equal(t, state.probes, a.CurrentStatus().Probes)
+
+	// Checkins use the last results rather than running the probes
+	assert.NoError(t, os.WriteFile(device, nil, 0600))
+	_, err = a.checkin(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, checkinPoolLabels)
+
+	a.evaluateProbes(context.Background())
+	_, err = a.checkin(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hil", "dut-a"}, checkinPoolLabels)
+	assert.True(t, a.probesHealthy())
+	assert.True(t, probesHealth(a.getState()).OK)
+}
+
+func TestRefreshProbes(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "ttyUSB0")
+	a := New(nil)
+	a.HealthProbeTimeout = time.Second
+	a.HealthProbeInterval = time.Hour
+	a.HealthProbes = []HealthProbe{{Name: "serial", Device: device}}
+
+	// The probes are evaluated the first time
+	assert.False(t, allHealthy(a.refreshProbes(context.Background())))
+
+	// Recent results are used rather than running the probes again
+	assert.NoError(t, os.WriteFile(device, nil, 0600))
+	assert.False(t, allHealthy(a.refreshProbes(context.Background())))
+
+	// Results older than the interval are refreshed
+	a.HealthProbeInterval = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	assert.True(t, allHealthy(a.refreshProbes(context.Background())))
+	assert.True(t, a.probesHealthy())
+}
+
+func TestEvaluateProbesSerialised(t *testing.T) {
+	// The probe leaves a marker if another run of it is in progress
+	dir := t.TempDir()
+	lock := filepath.Join(dir, "lock")
+	overlapped := filepath.Join(dir, "overlapped")
+	a := New(nil)
+	a.HealthProbeTimeout = 5 * time.Second
+	a.HealthProbes = []HealthProbe{{Name: "dut", Command: []string{"sh", "-c", "mkdir " + lock + " || touch " + overlapped + "; sleep 0.05; rmdir " + lock}}}
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.evaluateProbes(context.Background())
+		}()
+	}
+	wg.Wait()
+	assert.NoFileExists(t, overlapped)
+}
+
+func TestStartHealthProbesStops(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "ttyUSB0")
+	a := New(nil)
+	a.HealthProbeTimeout = time.Second
+	a.HealthProbeInterval = time.Millisecond
+	a.HealthProbes = []HealthProbe{{Name: "serial", Device: device}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.startHealthProbes(ctx)
+	assert.False(t, a.probesHealthy())
+	assert.NoError(t, os.WriteFile(device, nil, 0600))
+	assert.Eventually(t, a.probesHealthy, 5*time.Second, time.Millisecond)
+
+	// Once cancelled, the probes are no longer evaluated
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, os.Remove(device))
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, a.probesHealthy())
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"strings"
+)
+
+// DefaultRedactPatterns are the key patterns whose values are always masked in
+// log output and the effective config. Patterns use path.Match syntax and are
+// matched case-insensitively against config keys and environment variable names.
+var DefaultRedactPatterns = []string{
+	"*TOKEN*",
+	"*SECRET*",
+	"*PASSWORD*",
+	"*CREDENTIAL*",
+	"*API_KEY*",
+	"*PRIVATE_KEY*",
+}
+
+type Redactor struct {
+	patterns []string
+}
+
+func NewRedactor(patterns []string) *Redactor {
+	r := &Redactor{}
+	for _, pattern := range patterns {
+		r.patterns = append(r.patterns, strings.ToUpper(pattern))
+	}
+	return r
+}
+
+// IsSensitive reports whether the given key matches any of the redact patterns.
+// Dashes are treated as underscores so that config keys and env var names match alike.
+func (r *Redactor) IsSensitive(key string) bool {
+	key = strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+	for _, pattern := range r.patterns {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactEnvVar masks the value of a KEY=VALUE string if the key is sensitive.
+func (r *Redactor) RedactEnvVar(envVar string) string {
+	key, _, found := strings.Cut(envVar, "=")
+	if found && r.IsSensitive(key) {
+		return key + "=" + redactedValue
+	}
+	return envVar
+}
+
+func (r *Redactor) RedactEnvVars(envVars []string) []string {
+	redacted := make([]string, len(envVars))
+	for i, envVar := range envVars {
+		redacted[i] = r.RedactEnvVar(envVar)
+	}
+	return redacted
+}
+
+func (r *Redactor) RedactCustomEnvVars(envVars []EnvVar) []EnvVar {
+	redacted := make([]EnvVar, len(envVars))
+	for i, envVar := range envVars {
+		redacted[i] = envVar
+		if r.IsSensitive(envVar.Key) {
+			redacted[i].Value = redactedValue
+		}
+	}
+	return redacted
+}
+
+func (r *Redactor) RedactCustomWorkerConfig(config CustomWorkerConfig) CustomWorkerConfig {
+	config.EnvVars = r.RedactCustomEnvVars(config.EnvVars)
+	return config
+}
+
+// RedactSettings returns a copy of a viper settings map with sensitive values masked,
+// including sensitive entries in the environment-variables list.
+func (r *Redactor) RedactSettings(settings map[string]any) map[string]any {
+	redacted := make(map[string]any, len(settings))
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]any:
+			redacted[key] = r.RedactSettings(v)
+		default:
+			if r.IsSensitive(key) {
+				redacted[key] = redactedValue
+			} else {
+				redacted[key] = r.redactValue(value)
+			}
+		}
+	}
+	return redacted
+}
+
+// redactValue masks sensitive KEY=VALUE strings and known config types.
+func (r *Redactor) redactValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		return r.RedactEnvVar(v)
+	case []string:
+		return r.RedactEnvVars(v)
+	case []any:
+		redacted := make([]any, len(v))
+		for i, item := range v {
+			redacted[i] = r.redactValue(item)
+		}
+		return redacted
+	case map[string]any:
+		// e.g. the entries of a list of credentials
+		return r.RedactSettings(v)
+	case EnvVar:
+		return r.RedactCustomEnvVars([]EnvVar{v})[0]
+	case []EnvVar:
+		return r.RedactCustomEnvVars(v)
+	case CustomWorkerConfig:
+		return r.RedactCustomWorkerConfig(v)
+	default:
+		return value
+	}
+}
+
+func (r *Redactor) redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch {
+	case value.Kind() == slog.KindGroup:
+		attrs := value.Group()
+		redacted := make([]any, len(attrs))
+		for i, groupAttr := range attrs {
+			redacted[i] = r.redactAttr(groupAttr)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case r.IsSensitive(attr.Key):
+		return slog.String(attr.Key, redactedValue)
+	case value.Kind() == slog.KindString:
+		return slog.String(attr.Key, r.RedactEnvVar(value.String()))
+	case value.Kind() == slog.KindAny:
+		return slog.Any(attr.Key, r.redactValue(value.Any()))
+	default:
+		return attr
+	}
+}
+
+// RedactingHandler wraps a slog.Handler, masking the values of sensitive
+// attributes before they reach the underlying handler.
+type RedactingHandler struct {
+	handler  slog.Handler
+	redactor *Redactor
+}
+
+func NewRedactingHandler(handler slog.Handler, redactor *Redactor) *RedactingHandler {
+	return &RedactingHandler{
+		handler:  handler,
+		redactor: redactor,
+	}
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactor.redactAttr(attr))
+		return true
+	})
+	return h.handler.Handle(ctx, redacted)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = h.redactor.redactAttr(attr)
+	}
+	return NewRedactingHandler(h.handler.WithAttrs(redacted), h.redactor)
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return NewRedactingHandler(h.handler.WithGroup(name), h.redactor)
+}
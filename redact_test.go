@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactorIsSensitive(t *testing.T) {
+	r := NewRedactor(append(DefaultRedactPatterns, "DB_PASS"))
+
+	assert.True(t, r.IsSensitive("GITHUB_TOKEN"))
+	assert.True(t, r.IsSensitive("aws-secret-access-key"))
+	assert.True(t, r.IsSensitive("password"))
+	assert.True(t, r.IsSensitive("db_pass"))
+	assert.False(t, r.IsSensitive("DB_PASSTHROUGH_MODE"))
+	assert.False(t, r.IsSensitive("REPUNS_ENABLED"))
+}
+
+func TestRedactorEnvVars(t *testing.T) {
+	r := NewRedactor(DefaultRedactPatterns)
+
+	assert.Equal(t, []string{
+		"RERUN_WORKER_AUTH_TOKEN=" + redactedValue,
+		"CAFFEINE_LEVEL=zero",
+		"NOT_AN_ENV_VAR",
+	}, r.RedactEnvVars([]string{
+		"RERUN_WORKER_AUTH_TOKEN=foo-worker-token",
+		"CAFFEINE_LEVEL=zero",
+		"NOT_AN_ENV_VAR",
+	}))
+
+	assert.Equal(t, CustomWorkerConfig{
+		Mounts: []Mount{{Source: "/a", Target: "/b"}},
+		EnvVars: []EnvVar{
+			{Key: "MY_SECRET", Value: redactedValue},
+			{Key: "MY_SETTING", Value: "visible"},
+		},
+	}, r.RedactCustomWorkerConfig(CustomWorkerConfig{
+		Mounts: []Mount{{Source: "/a", Target: "/b"}},
+		EnvVars: []EnvVar{
+			{Key: "MY_SECRET", Value: "hidden"},
+			{Key: "MY_SETTING", Value: "visible"},
+		},
+	}))
+}
+
+func TestRedactorSettings(t *testing.T) {
+	r := NewRedactor(DefaultRedactPatterns)
+
+	assert.Equal(t, map[string]any{
+		"name": "test-agent",
+		"auth": map[string]any{"password": redactedValue},
+		"mirrors": []any{
+			map[string]any{"registry": "registry.example.com", "username": "robot", "password": redactedValue},
+			map[string]any{"registry": "ecr.example.com", "helper": "ecr-login"},
+		},
+	}, r.RedactSettings(map[string]any{
+		"name": "test-agent",
+		"auth": map[string]any{"password": "hunter2"},
+		"mirrors": []any{
+			map[string]any{"registry": "registry.example.com", "username": "robot", "password": "hunter2"},
+			map[string]any{"registry": "ecr.example.com", "helper": "ecr-login"},
+		},
+	}))
+}
+
+func TestRedactingHandler(t *testing.T) {
+	var buffer bytes.Buffer
+	r := NewRedactor(DefaultRedactPatterns)
+	logger := slog.New(NewRedactingHandler(slog.NewTextHandler(&buffer, nil), r))
+
+	logger.With("password", "hunter2").Info("loaded config",
+		"envVars", []EnvVar{{Key: "API_TOKEN", Value: "abc123"}},
+		"env", []string{"DB_SECRET=s3cr3t"},
+		"raw", "SESSION_TOKEN=xyz789",
+		slog.Group("worker", "auth_token", "foo-worker-token"),
+		"name", "test-agent",
+	)
+
+	output := buffer.String()
+	for _, secret := range []string{"hunter2", "abc123", "s3cr3t", "xyz789", "foo-worker-token"} {
+		assert.NotContains(t, output, secret)
+	}
+	assert.Contains(t, output, "name=test-agent")
+	assert.Contains(t, output, "API_TOKEN")
+}
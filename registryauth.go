@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/registry"
+)
+
+// registryCredentialTTL is how long credentials are reused before they are looked
+// up again, so that short-lived tokens, e.g. ECR's, which last 12 hours, are
+// refreshed well before they expire.
+const registryCredentialTTL = time.Hour
+
+// credentialHelperTimeout is how long a credential helper may run for before it
+// is killed, so that a hung helper doesn't block pulling the worker image.
+var credentialHelperTimeout = 30 * time.Second
+
+// credentialHelperWaitDelay is how long a credential helper's output is waited
+// for after it is killed, in case it started processes that hold it open.
+const credentialHelperWaitDelay = 5 * time.Second
+
+// dockerHubServerAddress is the key Docker uses for Docker Hub's credentials.
+const dockerHubServerAddress = "https://index.docker.io/v1/"
+
+// RegistryCredential configures the credentials for a registry: either a username
+// and password, or a Docker credential helper, e.g. ecr-login for
+// docker-credential-ecr-login.
+type RegistryCredential struct {
+	Registry string `mapstructure:"registry"`
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	Helper   string `mapstructure:"helper"`
+}
+
+// dockerConfigFile is the part of ~/.docker/config.json that holds credentials.
+type dockerConfigFile struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+type cachedRegistryCredential struct {
+	auth    registry.AuthConfig
+	expires time.Time
+}
+
+// errCredentialsNotFound is returned by credential helpers that have no
+// credentials for a registry.
+var errCredentialsNotFound = errors.New("credentials not found")
+
+// RegistryAuthenticator finds the credentials to pull images with, from the
+// agent's config or the Docker config file, as the daemon doesn't use the
+// agent's Docker config.
+type RegistryAuthenticator struct {
+	credentials      []RegistryCredential
+	dockerConfigPath string
+	// runHelper runs a credential helper; it is replaced in tests
+	runHelper func(helper string, serverAddress string) (registry.AuthConfig, error)
+
+	mutex sync.Mutex
+	cache map[string]cachedRegistryCredential
+}
+
+func NewRegistryAuthenticator(credentials []RegistryCredential, dockerConfigPath string) *RegistryAuthenticator {
+	return &RegistryAuthenticator{
+		credentials:      credentials,
+		dockerConfigPath: dockerConfigPath,
+		runHelper:        runCredentialHelper,
+		cache:            map[string]cachedRegistryCredential{},
+	}
+}
+
+// defaultDockerConfigPath is where the Docker CLI keeps its config.
+func defaultDockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".docker", "config.json")
+}
+
+// registryHost returns the registry an image is pulled from.
+func registryHost(imageURI string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(imageURI)
+	if err != nil {
+		return "", err
+	}
+	return reference.Domain(named), nil
+}
+
+// RegistryAuth returns the encoded credentials to pull imageURI with, or an empty
+// string if there are none, in which case the pull is anonymous.
+func (r *RegistryAuthenticator) RegistryAuth(imageURI string) (string, error) {
+	host, err := registryHost(imageURI)
+	if err != nil {
+		return "", err
+	}
+
+	r.mutex.Lock()
+	cached, ok := r.cache[host]
+	r.mutex.Unlock()
+	if !ok || time.Now().After(cached.expires) {
+		// The mutex isn't held while looking up credentials, as a credential helper
+		// may take a while, and Invalidate mustn't wait for it
+		auth, err := r.lookup(host)
+		if errors.Is(err, errCredentialsNotFound) {
+			auth, err = registry.AuthConfig{}, nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("error getting credentials for %v: %w", host, err)
+		}
+		cached = cachedRegistryCredential{auth: auth, expires: time.Now().Add(registryCredentialTTL)}
+		r.mutex.Lock()
+		r.cache[host] = cached
+		r.mutex.Unlock()
+	}
+	if cached.auth.Username == "" && cached.auth.Password == "" && cached.auth.IdentityToken == "" {
+		return "", nil
+	}
+	return registry.EncodeAuthConfig(cached.auth)
+}
+
+// Invalidate forgets the credentials for imageURI's registry, e.g. after they
+// were rejected, so that they are looked up again.
+func (r *RegistryAuthenticator) Invalidate(imageURI string) {
+	host, err := registryHost(imageURI)
+	if err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.cache, host)
+}
+
+// lookup finds the credentials for host in the agent's config, then the Docker
+// config file's credential helpers, credential store and stored credentials.
+func (r *RegistryAuthenticator) lookup(host string) (registry.AuthConfig, error) {
+	serverAddress := host
+	if host == "docker.io" {
+		serverAddress = dockerHubServerAddress
+	}
+
+	for _, credential := range r.credentials {
+		if !strings.EqualFold(credential.Registry, host) && credential.Registry != serverAddress {
+			continue
+		}
+		if credential.Helper != "" {
+			slog.Debug("Using configured credential helper", "registry", host, "helper", credential.Helper)
+			return r.runHelper(credential.Helper, serverAddress)
+		}
+		slog.Debug("Using configured registry credentials", "registry", host, "username", credential.Username)
+		return registry.AuthConfig{Username: credential.Username, Password: credential.Password, ServerAddress: serverAddress}, nil
+	}
+
+	if r.dockerConfigPath == "" {
+		return registry.AuthConfig{}, nil
+	}
+	data, err := os.ReadFile(r.dockerConfigPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return registry.AuthConfig{}, nil
+	}
+	if err != nil {
+		return registry.AuthConfig{}, err
+	}
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("error parsing %v: %w", r.dockerConfigPath, err)
+	}
+
+	if helper, ok := config.CredHelpers[serverAddress]; ok {
+		slog.Debug("Using credential helper from Docker config", "registry", host, "helper", helper)
+		return r.runHelper(helper, serverAddress)
+	}
+	if config.CredsStore != "" {
+		auth, err := r.runHelper(config.CredsStore, serverAddress)
+		if !errors.Is(err, errCredentialsNotFound) {
+			return auth, err
+		}
+	}
+	stored, ok := config.Auths[serverAddress]
+	if !ok {
+		return registry.AuthConfig{}, nil
+	}
+	auth := registry.AuthConfig{
+		Username:      stored.Username,
+		Password:      stored.Password,
+		IdentityToken: stored.IdentityToken,
+		ServerAddress: serverAddress,
+	}
+	if stored.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(stored.Auth)
+		if err != nil {
+			return registry.AuthConfig{}, fmt.Errorf("error decoding credentials for %v in %v: %w", host, r.dockerConfigPath, err)
+		}
+		auth.Username, auth.Password, _ = strings.Cut(string(decoded), ":")
+	}
+	return auth, nil
+}
+
+// runCredentialHelper gets credentials from a Docker credential helper, e.g.
+// docker-credential-ecr-login, which must be on the PATH. The helper is killed if
+// it runs for longer than credentialHelperTimeout.
+func runCredentialHelper(helper string, serverAddress string) (registry.AuthConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = credentialHelperWaitDelay
+	out, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return registry.AuthConfig{}, fmt.Errorf("docker-credential-%v timed out after %v", helper, credentialHelperTimeout)
+	}
+	if err != nil {
+		message := strings.TrimSpace(string(out) + stderr.String())
+		if strings.Contains(message, errCredentialsNotFound.Error()) {
+			return registry.AuthConfig{}, errCredentialsNotFound
+		}
+		return registry.AuthConfig{}, fmt.Errorf("error running docker-credential-%v: %w: %v", helper, err, message)
+	}
+	var credentials struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(out, &credentials); err != nil {
+		return registry.AuthConfig{}, fmt.Errorf("error parsing docker-credential-%v output: %w", helper, err)
+	}
+	auth := registry.AuthConfig{ServerAddress: serverAddress}
+	// Helpers return identity tokens with this placeholder username
+	if credentials.Username == "<token>" {
+		auth.IdentityToken = credentials.Secret
+	} else {
+		auth.Username = credentials.Username
+		auth.Password = credentials.Secret
+	}
+	return auth, nil
+}
+
+// isRegistryAuthError reports whether a pull failed because the registry rejected
+// the credentials, or needed some.
+func isRegistryAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := strings.ToLower(err.Error())
+	for _, pattern := range []string{"unauthorized", "authentication required", "no basic auth credentials", "denied"} {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// registryAuth returns the encoded credentials to pull imageURI with. Failing to
+// find credentials isn't fatal, as the image may be public or already present.
+func (a *Agent) registryAuth(imageURI string) string {
+	if a.RegistryAuthenticator == nil {
+		return ""
+	}
+	auth, err := a.RegistryAuthenticator.RegistryAuth(imageURI)
+	if err != nil {
+		slog.Warn("Error getting registry credentials, pulling anonymously", "image", imageURI, "err", err)
+		return ""
+	}
+	return auth
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func decodeRegistryAuth(t *testing.T, encoded string) registry.AuthConfig {
+	data, err := base64.URLEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+	var auth registry.AuthConfig
+	assert.NoError(t, json.Unmarshal(data, &auth))
+	return auth
+}
+
+func TestRegistryAuthenticator(t *testing.T) {
+	dockerConfigPath := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(dockerConfigPath, []byte(`{
+	"auths": {
+		"ghcr.io": {"auth": "`+base64.StdEncoding.EncodeToString([]byte("octocat:ghp_secret"))+`"},
+		"https://index.docker.io/v1/": {"username": "hubuser", "password": "hubpassword"},
+		"quay.io": {}
+	},
+	"credsStore": "desktop",
+	"credHelpers": {
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": "ecr-login"
+	}
+}`), 0600))
+
+	r := NewRegistryAuthenticator([]RegistryCredential{
+		{Registry: "registry.example.com", Username: "robot", Password: "hunter2"},
+		{Registry: "mirror.example.com", Helper: "mirror"},
+	}, dockerConfigPath)
+	var helperCalls []string
+	r.runHelper = func(helper string, serverAddress string) (registry.AuthConfig, error) {
+		helperCalls = append(helperCalls, helper+" "+serverAddress)
+		switch helper {
+		case "ecr-login":
+			return registry.AuthConfig{Username: "AWS", Password: "ecr-token", ServerAddress: serverAddress}, nil
+		case "mirror":
+			return registry.AuthConfig{IdentityToken: "mirror-token", ServerAddress: serverAddress}, nil
+		}
+		return registry.AuthConfig{}, errCredentialsNotFound
+	}
+
+	for imageURI, expected := range map[string]registry.AuthConfig{
+		"registry.example.com/resim/worker:v1":                             {Username: "robot", Password: "hunter2", ServerAddress: "registry.example.com"},
+		"mirror.example.com/resim/worker:v1":                               {IdentityToken: "mirror-token", ServerAddress: "mirror.example.com"},
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:latest": {Username: "AWS", Password: "ecr-token", ServerAddress: "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		"ghcr.io/resim-ai/worker:v1":                                       {Username: "octocat", Password: "ghp_secret", ServerAddress: "ghcr.io"},
+		"resim/worker:v1":                                                  {Username: "hubuser", Password: "hubpassword", ServerAddress: dockerHubServerAddress},
+	} {
+		encoded, err := r.RegistryAuth(imageURI)
+		assert.NoError(t, err, imageURI)
+		assert.Equal(t, expected, decodeRegistryAuth(t, encoded), imageURI)
+	}
+
+	// No credentials anywhere, so the pull is anonymous
+	for _, imageURI := range []string{"public.ecr.aws/resim/experience-worker:latest", "quay.io/resim/worker:v1"} {
+		encoded, err := r.RegistryAuth(imageURI)
+		assert.NoError(t, err)
+		assert.Empty(t, encoded)
+	}
+
+	// Credentials are cached until they are invalidated
+	helperCalls = nil
+	_, err := r.RegistryAuth("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+	assert.NoError(t, err)
+	assert.Empty(t, helperCalls)
+	r.Invalidate("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+	_, err = r.RegistryAuth("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ecr-login 123456789012.dkr.ecr.us-east-1.amazonaws.com"}, helperCalls)
+
+	// Helper failures are reported
+	r.runHelper = func(helper string, serverAddress string) (registry.AuthConfig, error) {
+		return registry.AuthConfig{}, errors.New("no AWS credentials")
+	}
+	r.Invalidate("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+	_, err = r.RegistryAuth("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+	assert.ErrorContains(t, err, "no AWS credentials")
+
+	// Invalidate doesn't wait for a running helper
+	helperStarted := make(chan struct{})
+	releaseHelper := make(chan struct{})
+	r.runHelper = func(helper string, serverAddress string) (registry.AuthConfig, error) {
+		close(helperStarted)
+		<-releaseHelper
+		return registry.AuthConfig{}, errCredentialsNotFound
+	}
+	done := make(chan error)
+	go func() {
+		_, err := r.RegistryAuth("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+		done <- err
+	}()
+	<-helperStarted
+	r.Invalidate("123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:v2")
+	close(releaseHelper)
+	assert.NoError(t, <-done)
+
+	// A missing Docker config isn't an error
+	r = NewRegistryAuthenticator(nil, filepath.Join(t.TempDir(), "config.json"))
+	encoded, err := r.RegistryAuth("ghcr.io/resim-ai/worker:v1")
+	assert.NoError(t, err)
+	assert.Empty(t, encoded)
+}
+
+func TestRunCredentialHelper(t *testing.T) {
+	binDir := t.TempDir()
+	helper := `#!/bin/sh
+read server
+case "$server" in
+  token.example.com) echo '{"ServerURL":"token.example.com","Username":"<token>","Secret":"identity"}' ;;
+  user.example.com) echo '{"ServerURL":"user.example.com","Username":"AWS","Secret":"password"}' ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-test"), []byte(helper), 0700))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	auth, err := runCredentialHelper("test", "token.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, registry.AuthConfig{IdentityToken: "identity", ServerAddress: "token.example.com"}, auth)
+
+	auth, err = runCredentialHelper("test", "user.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, registry.AuthConfig{Username: "AWS", Password: "password", ServerAddress: "user.example.com"}, auth)
+
+	_, err = runCredentialHelper("test", "other.example.com")
+	assert.ErrorIs(t, err, errCredentialsNotFound)
+
+	_, err = runCredentialHelper("missing", "other.example.com")
+	assert.ErrorContains(t, err, "error running docker-credential-missing")
+
+	// A hung helper is killed
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "docker-credential-hung"), []byte("#!/bin/sh\nexec sleep 10\n"), 0700))
+	defaultTimeout := credentialHelperTimeout
+	credentialHelperTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { credentialHelperTimeout = defaultTimeout })
+	start := time.Now()
+	_, err = runCredentialHelper("hung", "other.example.com")
+	assert.ErrorContains(t, err, "docker-credential-hung timed out")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestPullImageRefreshesRejectedCredentials(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.Platform = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	a.RegistryAuthenticator = NewRegistryAuthenticator([]RegistryCredential{
+		{Registry: "123456789012.dkr.ecr.us-east-1.amazonaws.com", Helper: "ecr-login"},
+	}, "")
+	tokens := []string{"expired", "fresh"}
+	a.RegistryAuthenticator.runHelper = func(helper string, serverAddress string) (registry.AuthConfig, error) {
+		token := tokens[0]
+		tokens = tokens[1:]
+		return registry.AuthConfig{Username: "AWS", Password: token, ServerAddress: serverAddress}, nil
+	}
+	imageURI := "123456789012.dkr.ecr.us-east-1.amazonaws.com/resim/worker:latest"
+	withPassword := func(password string) any {
+		return mock.MatchedBy(func(options image.PullOptions) bool {
+			return options.Platform == "linux/amd64" && decodeRegistryAuth(t, options.RegistryAuth).Password == password
+		})
+	}
+
+	mockDocker.On("ImagePull", mock.Anything, imageURI, withPassword("expired")).Return(io.NopCloser(strings.NewReader(
+		`{"errorDetail":{"message":"pull access denied"},"error":"pull access denied"}`)), nil).Once()
+	mockDocker.On("ImagePull", mock.Anything, imageURI, withPassword("fresh")).Return(pullStream(testDigest1), nil).Once()
+
+	progress, err := a.pullImage(context.Background(), imageURI)
+	assert.NoError(t, err)
+	assert.Equal(t, testDigest1, progress.Digest)
+}
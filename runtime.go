@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+)
+
+// ContainerRuntime is the engine behind the Docker API the agent uses.
+type ContainerRuntime string
+
+const (
+	ContainerRuntimeDocker ContainerRuntime = "docker"
+	ContainerRuntimePodman ContainerRuntime = "podman"
+)
+
+// runtimeSocketCandidates lists the sockets to look for, in order, when neither
+// container-runtime-socket nor DOCKER_HOST is set: rootless Docker, Docker,
+// rootless Podman and Podman.
+func runtimeSocketCandidates() []string {
+	var candidates []string
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		candidates = append(candidates, filepath.Join(runtimeDir, "docker.sock"))
+	}
+	candidates = append(candidates, DockerSocketPath)
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		candidates = append(candidates, filepath.Join(runtimeDir, "podman", "podman.sock"))
+	}
+	return append(candidates, "/run/podman/podman.sock")
+}
+
+// detectRuntimeHost returns the address of the container runtime's API: the
+// configured socket, DOCKER_HOST, or the first of the candidate sockets that
+// exists. It falls back to the default Docker socket.
+func detectRuntimeHost(configured string, candidates []string) string {
+	if configured != "" {
+		return runtimeHostFromSocket(configured)
+	}
+	if dockerHost := os.Getenv("DOCKER_HOST"); dockerHost != "" {
+		return dockerHost
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return runtimeHostFromSocket(candidate)
+		}
+	}
+	return runtimeHostFromSocket(DockerSocketPath)
+}
+
+// runtimeHostFromSocket accepts either a socket path or an address with a scheme,
+// e.g. unix:///run/podman/podman.sock or tcp://docker:2375.
+func runtimeHostFromSocket(socket string) string {
+	if strings.Contains(socket, "://") {
+		return socket
+	}
+	return "unix://" + socket
+}
+
+// runtimeSocketPath returns the path of the runtime's socket, if it is a Unix socket.
+func (a *Agent) runtimeSocketPath() (string, bool) {
+	return strings.CutPrefix(a.RuntimeHost, "unix://")
+}
+
+// NewDockerClient creates a client for the runtime at host. Other settings, e.g.
+// TLS, are read from the environment, and the API version is negotiated as
+// Podman supports older versions than the client's default.
+func NewDockerClient(host string) (*client.Client, error) {
+	return client.NewClientWithOpts(client.FromEnv, client.WithHost(host), client.WithAPIVersionNegotiation())
+}
+
+func containerRuntimeFromVersion(version types.Version) ContainerRuntime {
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), "podman") {
+			return ContainerRuntimePodman
+		}
+	}
+	return ContainerRuntimeDocker
+}
+
+// detectContainerRuntime asks the runtime what it is, as Podman's Docker API
+// compatibility needs some differences in how the worker is run, and what
+// platform it runs on.
+func (a *Agent) detectContainerRuntime(ctx context.Context) {
+	version, err := a.Docker.ServerVersion(ctx)
+	if err != nil {
+		slog.Warn("Error getting container runtime version, assuming Docker", "err", err)
+	}
+	a.ContainerRuntime = containerRuntimeFromVersion(version)
+	a.detectPlatform(version)
+	slog.Info("Found container runtime", "runtime", a.ContainerRuntime, "version", version.Version, "api_version", version.APIVersion, "host", a.RuntimeHost, "platform", formatPlatform(a.Platform))
+}
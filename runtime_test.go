@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuntimeSocketCandidates(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	assert.Equal(t, []string{
+		"/run/user/1000/docker.sock",
+		"/var/run/docker.sock",
+		"/run/user/1000/podman/podman.sock",
+		"/run/podman/podman.sock",
+	}, runtimeSocketCandidates())
+
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	assert.Equal(t, []string{"/var/run/docker.sock", "/run/podman/podman.sock"}, runtimeSocketCandidates())
+}
+
+func TestDetectRuntimeHost(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "")
+	runtimeDir := t.TempDir()
+	rootlessDocker := filepath.Join(runtimeDir, "docker.sock")
+	rootlessPodman := filepath.Join(runtimeDir, "podman.sock")
+	candidates := []string{rootlessDocker, rootlessPodman}
+
+	// Nothing found
+	assert.Equal(t, "unix:///var/run/docker.sock", detectRuntimeHost("", candidates))
+
+	// The first candidate that exists
+	assert.NoError(t, os.WriteFile(rootlessPodman, nil, 0600))
+	assert.Equal(t, "unix://"+rootlessPodman, detectRuntimeHost("", candidates))
+	assert.NoError(t, os.WriteFile(rootlessDocker, nil, 0600))
+	assert.Equal(t, "unix://"+rootlessDocker, detectRuntimeHost("", candidates))
+
+	// DOCKER_HOST takes precedence over the candidates
+	t.Setenv("DOCKER_HOST", "tcp://docker:2375")
+	assert.Equal(t, "tcp://docker:2375", detectRuntimeHost("", candidates))
+
+	// The configured socket takes precedence over everything
+	assert.Equal(t, "unix:///run/podman/podman.sock", detectRuntimeHost("/run/podman/podman.sock", candidates))
+	assert.Equal(t, "unix:///run/podman/podman.sock", detectRuntimeHost("unix:///run/podman/podman.sock", candidates))
+}
+
+func TestContainerRuntimeFromVersion(t *testing.T) {
+	assert.Equal(t, ContainerRuntimeDocker, containerRuntimeFromVersion(types.Version{
+		Components: []types.ComponentVersion{{Name: "Engine"}, {Name: "containerd"}},
+	}))
+	assert.Equal(t, ContainerRuntimePodman, containerRuntimeFromVersion(types.Version{
+		Components: []types.ComponentVersion{{Name: "Podman Engine"}},
+	}))
+}
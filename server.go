@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newHTTPHandler returns the handler for the agent's local HTTP server.
+func (a *Agent) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", a.handleHealthz)
+	mux.HandleFunc("GET /readyz", a.handleReadyz)
+	return mux
+}
+
+// startHTTPServer starts the agent's local HTTP server, if a listen address is configured.
+func (a *Agent) startHTTPServer() error {
+	if a.HTTPListenAddress == "" {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", a.HTTPListenAddress)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:           a.newHTTPHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("agent HTTP server stopped", "err", err)
+		}
+	}()
+	slog.Info("agent HTTP server listening", "address", listener.Addr().String())
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state notification to systemd, if the agent was started by a
+// systemd service with Type=notify. It is a no-op otherwise.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+	// Abstract namespace sockets are passed with a leading @
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the interval at which systemd expects watchdog
+// notifications, or zero if the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// startSystemdNotify tells systemd the agent is ready and, if the watchdog is
+// enabled, pets it at half the watchdog interval for as long as the agent is live.
+func (a *Agent) startSystemdNotify() {
+	err := sdNotify("READY=1")
+	if err != nil {
+		slog.Warn("error notifying systemd", "err", err)
+	}
+
+	interval := watchdogInterval()
+	if interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval / 2)
+	go func() {
+		for range ticker.C {
+			if !a.Liveness().OK {
+				slog.Warn("agent is not live, skipping systemd watchdog notification")
+				continue
+			}
+			err := sdNotify("WATCHDOG=1")
+			if err != nil {
+				slog.Warn("error notifying systemd watchdog", "err", err)
+			}
+		}
+	}()
+}
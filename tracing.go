@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/resim-ai/agent/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/resim-ai/agent"
+
+// startSpan starts a span with the current global tracer provider, which is
+// looked up each time so that it can be replaced, e.g. in tests.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// initTracing configures an OTLP/HTTP trace exporter if a tracing endpoint is
+// configured. Otherwise, the default no-op tracer provider is left in place. The
+// returned function flushes and shuts down the exporter.
+func (a *Agent) initTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if a.TracingEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporterOptions := []otlptracehttp.Option{
+		otlptracehttp.WithEndpointURL(a.TracingEndpoint),
+		otlptracehttp.WithProxy(a.HTTPConfig.proxyFunc()),
+	}
+	tlsConfig, err := a.HTTPConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithTLSClientConfig(tlsConfig))
+	}
+	exporter, err := otlptracehttp.New(ctx, exporterOptions...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("resim-agent"),
+		semconv.ServiceVersion(agentVersion),
+		attribute.String("resim.agent.name", a.Name),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	return tracerProvider.Shutdown, nil
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// AddTraceContextEditor propagates the trace context of each request to the Agent API.
+func AddTraceContextEditor() api.RequestEditorFn {
+	return func(ctx context.Context, req *http.Request) error {
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+		return nil
+	}
+}
+
+// traceContextEnvVars returns the trace context as environment variables (e.g.
+// TRACEPARENT) for the worker, so that its spans join the agent's trace.
+func traceContextEnvVars(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	var envVars []string
+	for _, key := range carrier.Keys() {
+		envVars = append(envVars, strings.ToUpper(key)+"="+carrier.Get(key))
+	}
+	return envVars
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func setupTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTracerProvider(previousProvider) })
+	return recorder
+}
+
+func TestTraceContextPropagation(t *testing.T) {
+	recorder := setupTestTracing(t)
+
+	ctx, span := startSpan(context.Background(), "agent.iteration")
+	traceID := span.SpanContext().TraceID().String()
+
+	envVars := traceContextEnvVars(ctx)
+	assert.Len(t, envVars, 1)
+	assert.True(t, strings.HasPrefix(envVars[0], "TRACEPARENT=00-"+traceID+"-"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://agentapi.resim.ai/agent/v1/checkin", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, AddTraceContextEditor()(ctx, req))
+	assert.Contains(t, req.Header.Get("traceparent"), traceID)
+
+	endSpan(span, nil)
+	assert.Len(t, recorder.Ended(), 1)
+}
+
+func TestTraceContextNotPropagatedWithoutSpan(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	assert.Empty(t, traceContextEnvVars(context.Background()))
+}
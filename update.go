@@ -8,13 +8,12 @@ import (
 	"net/http"
 	"os"
 	"runtime"
-	"time"
 
 	"github.com/google/go-github/v66/github"
 	"golang.org/x/mod/semver"
 )
 
-func doUpdate(release *github.RepositoryRelease) error {
+func doUpdate(client *http.Client, release *github.RepositoryRelease) error {
 	var downloadURL string
 
 	desiredFilename := fmt.Sprintf("agent-%v-%v", runtime.GOOS, runtime.GOARCH)
@@ -25,9 +24,6 @@ func doUpdate(release *github.RepositoryRelease) error {
 		}
 	}
 
-	client := http.Client{
-		Timeout: 5 * time.Second,
-	}
 	req, err := http.NewRequest("GET", downloadURL, nil)
 	if err != nil {
 		slog.Error("error constructing update request", "err", err)
@@ -86,7 +82,7 @@ func doUpdate(release *github.RepositoryRelease) error {
 func (a *Agent) checkUpdate() error {
 	ctx := context.Background()
 
-	gh := github.NewClient(nil)
+	gh := github.NewClient(a.HTTPClient)
 
 	latestRelease, _, err := gh.Repositories.GetLatestRelease(ctx, "resim-ai", "agent")
 	if err != nil {
@@ -99,7 +95,7 @@ func (a *Agent) checkUpdate() error {
 		slog.Info("there is a newer version of the agent available", "available_version", *latestRelease.Name, "running_version", agentVersion)
 		if a.AutoUpdate {
 			slog.Debug("attempting automatic update")
-			err = doUpdate(latestRelease)
+			err = doUpdate(a.HTTPClient, latestRelease)
 			if err != nil {
 				slog.Error("error in automatic update", "err", err)
 				return err
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// WorkerTimeoutError is returned when the worker ran for longer than its timeout
+// and was stopped.
+type WorkerTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *WorkerTimeoutError) Error() string {
+	return fmt.Sprintf("worker timed out after %v and was stopped", e.Timeout)
+}
+
+// stopTimedOutWorker asks the worker to stop with SIGTERM, and the runtime kills
+// it if it hasn't exited after WorkerStopGracePeriod. If the worker can't be
+// stopped, it is killed.
+func (a *Agent) stopTimedOutWorker(ctx context.Context, containerID string) {
+	gracePeriod := int(a.WorkerStopGracePeriod.Seconds())
+	err := a.Docker.ContainerStop(ctx, containerID, container.StopOptions{
+		Signal:  "SIGTERM",
+		Timeout: &gracePeriod,
+	})
+	if err == nil {
+		return
+	}
+	slog.Warn("Error stopping worker, killing it", "worker", a.currentWorkerID, "err", err)
+	err = a.Docker.ContainerKill(ctx, containerID, "SIGKILL")
+	if err != nil {
+		slog.Warn("Error killing worker", "worker", a.currentWorkerID, "err", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestWatchWorkerTimeout(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.ContainerWatchInterval = time.Millisecond
+	a.WorkerMaxRuntime = time.Minute
+	a.WorkerStopGracePeriod = 10 * time.Second
+
+	running := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "running"}}}
+	exited := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "exited", ExitCode: 137}}}
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(running, nil).Once()
+	gracePeriod := 10
+	mockDocker.On("ContainerStop", mock.Anything, "worker", container.StopOptions{Signal: "SIGTERM", Timeout: &gracePeriod}).Return(nil).Once()
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(exited, nil).Once()
+
+	err := a.watchWorker(context.Background(), "worker", time.Now().Add(-2*time.Minute))
+	var timeoutErr *WorkerTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, time.Minute, timeoutErr.Timeout)
+	var runErr *WorkerRunError
+	assert.True(t, errors.As(err, &runErr))
+	assert.Equal(t, WorkerOutcomeTimeout, runErr.Outcome, "the worker's SIGTERM exit code is a timeout, not a signal")
+
+	// Within the timeout, the worker is left to run
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(running, nil).Once()
+	succeeded := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "exited"}}}
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(succeeded, nil).Once()
+	assert.NoError(t, a.watchWorker(context.Background(), "worker", time.Now()))
+}
+
+func TestWatchWorkerTimeoutStopError(t *testing.T) {
+	mockDocker := &MockDockerClient{}
+	defer mockDocker.AssertExpectations(t)
+	a := New(mockDocker)
+	a.ContainerWatchInterval = time.Millisecond
+	a.WorkerMaxRuntime = time.Minute
+	a.WorkerStopGracePeriod = 10 * time.Second
+
+	running := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "running"}}}
+	exited := types.ContainerJSON{ContainerJSONBase: &types.ContainerJSONBase{State: &types.ContainerState{Status: "exited", ExitCode: 137}}}
+	gracePeriod := 10
+	stopOptions := container.StopOptions{Signal: "SIGTERM", Timeout: &gracePeriod}
+
+	// If the worker can't be stopped, it is killed, and stopping is retried until it exits
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(running, nil).Twice()
+	mockDocker.On("ContainerStop", mock.Anything, "worker", stopOptions).Return(errors.New("daemon busy")).Twice()
+	mockDocker.On("ContainerKill", mock.Anything, "worker", "SIGKILL").Return(errors.New("daemon busy")).Once()
+	mockDocker.On("ContainerKill", mock.Anything, "worker", "SIGKILL").Return(nil).Once()
+	mockDocker.On("ContainerInspect", mock.Anything, "worker").Return(exited, nil).Once()
+
+	err := a.watchWorker(context.Background(), "worker", time.Now().Add(-2*time.Minute))
+	var timeoutErr *WorkerTimeoutError
+	assert.True(t, errors.As(err, &timeoutErr))
+	mockDocker.AssertNumberOfCalls(t, "ContainerKill", 2)
+}